@@ -7,12 +7,15 @@ import (
 	"image"
 	"image/png"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/tanaton/CSVToExcelGraph/app/config"
 	"github.com/tanaton/CSVToExcelGraph/app/graph"
@@ -24,19 +27,74 @@ import (
 // Newline 改行コードの指定
 const Newline = "\r\n"
 
+// 中間CSVの区切り文字
+const outComma = ','
+
 var pngEncoder = png.Encoder{
 	CompressionLevel: png.BestCompression,
 	BufferPool:       newPngPool(),
 }
 
+// 不正な行の処理方法
+const (
+	badRowError = "error"
+	badRowSkip  = "skip"
+	badRowPad   = "pad"
+	badRowStop  = "stop"
+)
+
+// ログに出力する不正な行番号の最大数
+const maxLogBadRows = 100
+
+// badRow 不正な行の位置（結合する場合は行番号がファイルごとなのでファイルの番号も持つ）
+type badRow struct {
+	file int
+	line int
+}
+
 // CSVReducer csvデータ削減用構造体
 type CSVReducer struct {
 	hmax        int
 	linenum     int
 	columnlist  []int
 	secondaries []int
-	reduceFunc  func(linenum int, cells []string) bool
-	bufcolumns  [256]string
+	reduceFunc  reduceFunc
+	flushFunc   flushFunc
+	prescanFunc reduceFunc
+	reduceErr   func() error
+	reduceAsync func(async asyncFunc)
+	preFlush    flushFunc
+	preAsync    func(async asyncFunc)
+	rmsColumns  bool
+	derived     []exprFunc
+	transforms  []func(string) string
+	filters     []filterFunc
+	filtered    bool
+	missingCols []*missingColumn
+	missing     *missingHandler
+	bufmissing  []bool
+	rowFilter   rowPredicate
+	xparse      func(string) (int64, bool)
+	xserial     bool
+	elapsed     bool
+	elapsedBy   string
+	origin      int64
+	hasOrigin   bool
+	trigger     rowPredicate
+	onBadRow    string
+	badRows     []badRow
+	paddedRows  []badRow
+	bufcolumns  []string
+	bufcells    []string
+	comma       byte
+	decimal     byte
+	metadata    map[string]string
+	header      []string
+	files       []string
+	fileIndex   int
+	stats       []*columnStats
+	statsOn     bool
+	workers     int
 }
 
 var log *zap.SugaredLogger
@@ -59,14 +117,37 @@ func Cui(ctx context.Context, cdir string) error {
 	if err != nil {
 		return err
 	}
-	rp := flag.CommandLine.Arg(0)
-	if rp == "" {
+	if flag.CommandLine.NArg() == 0 {
 		return fmt.Errorf("CSVファイルの指定がありません。")
 	}
-	if _, err := CreateGraph(c, rp); err != nil {
-		log.Warnw("グラフ生成失敗", "error", err)
-	} else {
-		log.Infow("グラフ生成成功")
+	files, err := expandInputs(c, flag.CommandLine.Args())
+	if err != nil {
+		return err
+	}
+	if c.Overlay && len(files) > 1 {
+		// 複数のファイルを重ねて1つのグラフにする
+		if _, err := CreateOverlayGraph(c, files); err != nil {
+			log.Warnw("グラフ生成失敗", "error", err)
+		} else {
+			log.Infow("グラフ生成成功", "ファイル数", len(files))
+		}
+		return nil
+	}
+	if c.Join != "" && len(files) > 1 {
+		// 分割されたファイルを1つのグラフにする
+		if _, err := CreateJoinedGraph(c, files); err != nil {
+			log.Warnw("グラフ生成失敗", "error", err)
+		} else {
+			log.Infow("グラフ生成成功", "ファイル数", len(files))
+		}
+		return nil
+	}
+	for _, file := range files {
+		if _, err := CreateGraph(c, file); err != nil {
+			log.Warnw("グラフ生成失敗", "path", file, "error", err)
+		} else {
+			log.Infow("グラフ生成成功", "path", file)
+		}
 	}
 	return nil
 }
@@ -110,12 +191,22 @@ func GetLog() *zap.SugaredLogger {
 	return log
 }
 
-func checkExtList(list []string, ext string) bool {
+// checkExtList すべてのファイルの拡張子がextsのいずれかの場合にtrueを返す
+// ".gz"と".zst"はその前の拡張子で判定する
+func checkExtList(list []string, exts ...string) bool {
 	if len(list) <= 0 {
 		return false
 	}
 	for _, name := range list {
-		if ext != filepath.Ext(name) {
+		ext := inputExt(name)
+		found := false
+		for _, it := range exts {
+			if ext == it {
+				found = true
+				break
+			}
+		}
+		if !found {
 			return false
 		}
 	}
@@ -124,20 +215,50 @@ func checkExtList(list []string, ext string) bool {
 
 // CreateGraph グラフ生成メイン処理呼び出し
 func CreateGraph(c *config.Config, rp string) (string, error) {
-	dir, name := filepath.Split(rp)
-	csvname := strings.TrimRight(name, filepath.Ext(rp)) + "_graph.csv"
+	dir, base := outputBase(rp)
+	return createGraph(c, []string{rp}, dir, base)
+}
+
+// CreateJoinedGraph 分割されたファイルを結合して1つのグラフを生成する
+func CreateJoinedGraph(c *config.Config, files []string) (string, error) {
+	files, err := orderJoinFiles(c, files)
+	if err != nil {
+		return "", err
+	}
+	dir, base := outputBase(files[0])
+	return createGraph(c, files, dir, base+"_join")
+}
+
+func createGraph(c *config.Config, files []string, dir, base string) (string, error) {
+	csvname := base + "_graph.csv"
 	dp, _ := filepath.Abs(filepath.Join(dir, csvname))
 	// 間引き
-	csv, err := reduceCSV(c, rp, dp)
+	csv, err := reduceFiles(c, files, dp)
 	if err != nil {
 		return "", err
 	}
+	title := expandTitle(c.Title, base, csv.metadata)
+	var summary [][]interface{}
+	if c.Stats {
+		// 間引く前のデータの統計値
+		if err := writeStatsJSON(filepath.Join(dir, base+"_stats.json"), csv.stats); err != nil {
+			return "", err
+		}
+		summary = statsSheet(csv.stats, csv.xFormat())
+	}
+	return renderGraph(dp, title, csv.secondaries, nil, summary, csv.xFormat())
+}
+
+// renderGraph 中間CSVからブックとグラフ画像を生成し、中間CSVを削除する
+// summaryがある場合はSummaryシートに書き込む
+// xformatはX列の表示形式（空の場合は設定しない）
+func renderGraph(dp, title string, secondaries []int, groups []string, summary [][]interface{}, xformat string) (string, error) {
 	wp := dp + ".xlsx"
 	ip := wp + ".png"
 	// スレッドを固定する
 	runtime.LockOSThread()
 	// グラフ描画
-	err = graph.Excelgraph(dp, wp, ip, csv.secondaries)
+	err := graph.Excelgraph(dp, wp, ip, title, secondaries, groups, summary, xformat)
 	// スレッドの固定を解除する（※ゴールーチンを抜けると自動でアンロックされる）
 	runtime.UnlockOSThread()
 	if err != nil {
@@ -157,111 +278,599 @@ func CreateGraph(c *config.Config, rp string) (string, error) {
 }
 
 func reduceCSV(c *config.Config, rp, wp string) (*CSVReducer, error) {
-	swc, err := NewScanWriteCloser(rp, wp)
+	return reduceFiles(c, []string{rp}, wp)
+}
+
+// reduceFiles 複数のファイルを順に読み込み、1つのCSVとして間引く
+func reduceFiles(c *config.Config, files []string, wp string) (*CSVReducer, error) {
+	csv, err := NewCSVReducer(c)
 	if err != nil {
 		return nil, err
 	}
-	defer swc.Close()
-	csv := NewCSVReducer(c)
-	// ヘッダー
-	err = csv.scanHeader(swc, c)
-	if err != nil {
-		return nil, err
+	if csv.elapsedBy == elapsedTrigger {
+		// 経過時間の基準となるトリガー行を先に探す
+		origin, err := findTrigger(c, files, wp)
+		if err != nil {
+			return nil, err
+		}
+		csv.origin, csv.hasOrigin = origin, true
 	}
-	// データ
-	err = csv.scanData(swc)
+	if csv.prescanFunc != nil {
+		// 間引き前に全体を一度読み込む必要がある場合
+		pre, err := NewCSVReducer(c)
+		if err != nil {
+			return nil, err
+		}
+		pre.reduceFunc = csv.prescanFunc
+		pre.flushFunc = csv.preFlush
+		pre.reduceAsync = csv.preAsync
+		pre.origin, pre.hasOrigin = csv.origin, csv.hasOrigin
+		if err := pre.scanCSV(c, files, wp); err != nil {
+			return nil, err
+		}
+	}
+	err = csv.scanCSV(c, files, wp)
 	if err != nil {
 		return nil, err
 	}
+	csv.logBadRows()
 	return csv, nil
 }
 
-// NewCSVReducer CSV間引き用構造体生成
-func NewCSVReducer(c *config.Config) *CSVReducer {
-	var f func(int, []string) bool
-	if c.ReduceRows > 0 {
-		f = func(rows int) func(int, []string) bool {
-			return func(linenum int, _ []string) bool {
-				if linenum%rows == 0 {
-					return false
-				}
-				// trueで間引く
-				return true
+// findTrigger Triggerの条件を最初に満たす行のXを返す
+func findTrigger(c *config.Config, files []string, wp string) (int64, error) {
+	swc, err := NewScanWriteCloser(c, files[0], wp)
+	if err != nil {
+		return 0, err
+	}
+	defer swc.Close()
+	csv, err := NewCSVReducer(c)
+	if err != nil {
+		return 0, err
+	}
+	csv.files = files
+	if err := csv.scanHeader(swc, c); err != nil {
+		return 0, err
+	}
+	for {
+		cells, err := csv.nextRow(swc)
+		if err != nil {
+			return 0, err
+		}
+		if cells == nil {
+			ok, err := csv.nextFile(swc, c)
+			if err != nil {
+				return 0, err
 			}
-		}(c.ReduceRows)
+			if ok {
+				continue
+			}
+			break
+		}
+		if !csv.trigger(cells) {
+			continue
+		}
+		if x, ok := csv.rawX(cells); ok {
+			return x, nil
+		}
+	}
+	return 0, fmt.Errorf("Triggerの条件を満たす行が見つかりませんでした。")
+}
+
+func (csv *CSVReducer) scanCSV(c *config.Config, files []string, wp string) error {
+	swc, err := NewScanWriteCloser(c, files[0], wp)
+	if err != nil {
+		return err
 	}
-	return &CSVReducer{
+	defer swc.Close()
+	csv.files = files
+	csv.workers = parallelWorkers(c, files)
+	// ヘッダー
+	err = csv.scanHeader(swc, c)
+	if err != nil {
+		return csv.fileError(err)
+	}
+	// データ
+	return csv.fileError(csv.scanData(swc, c))
+}
+
+// NewCSVReducer CSV間引き用構造体生成
+func NewCSVReducer(c *config.Config) (*CSVReducer, error) {
+	csv := &CSVReducer{
 		hmax:        0,
 		linenum:     0,
 		columnlist:  make([]int, 0, len(c.YColumns)+1),
 		secondaries: make([]int, 0, len(c.YColumns)+1),
-		reduceFunc:  f,
+		statsOn:     c.Stats,
+	}
+	switch strings.ToLower(c.OnBadRow) {
+	case "", badRowError, badRowSkip, badRowPad, badRowStop:
+		csv.onBadRow = strings.ToLower(c.OnBadRow)
+	default:
+		return nil, fmt.Errorf("不正な行の処理方法の指定が不正です。OnBadRow:%q", c.OnBadRow)
+	}
+	if err := csv.setXColumn(c.XColumn); err != nil {
+		return nil, err
+	}
+	if err := csv.setReducer(c); err != nil {
+		return nil, err
 	}
+	return csv, nil
 }
 
 func (csv *CSVReducer) scanHeader(swc ScanWriteCloser, c *config.Config) error {
 	// ヘッダー
-	if swc.Scan() == false {
-		return swc.Err()
+	header, err := csv.findHeader(swc, c)
+	if err != nil {
+		return err
 	}
-	csv.linenum++
 	cl := append([]config.Column{c.XColumn}, c.YColumns...)
-	cells := strings.Split(swc.Text(), ",")
+	comma, err := parseDelimiter(c.Delimiter, header)
+	if err != nil {
+		return err
+	}
+	csv.comma = comma
+	swc.SetComma(comma)
+	decimal, err := parseDecimalSeparator(c.DecimalSeparator)
+	if err != nil {
+		return err
+	}
+	csv.decimal = decimal
+	cells, err := parseRecord(nil, header, csv.comma)
+	if err != nil {
+		return fmt.Errorf("csvのヘッダーが読み込めませんでした。%w", err)
+	}
 	csv.hmax = len(cells)
-	swc.WriteString(csv.headerString(cells, cl) + Newline)
+	csv.header = cells
+	units, err := csv.scanUnits(swc, c)
+	if err != nil {
+		return err
+	}
+	missings := make([]*missingColumn, len(cl))
+	for i, it := range cl[1:] {
+		missings[i+1], err = newMissingColumn(it, c)
+		if err != nil {
+			return err
+		}
+	}
+	header, err = csv.headerString(cells, units, cl, missings, c.Derived)
+	if err != nil {
+		return err
+	}
+	csv.rowFilter, err = csv.compileRowFilter(c.Filter, cells)
+	if err != nil {
+		return err
+	}
+	if csv.elapsedBy == elapsedTrigger {
+		// トリガー行からの経過時間にする場合のみ使う
+		csv.trigger, err = csv.compileCondition(*c.XColumn.Trigger, cells)
+		if err != nil {
+			return err
+		}
+	}
+	swc.WriteString(header + Newline)
 	return nil
 }
 
-func (csv *CSVReducer) headerString(cells []string, cl []config.Column) string {
+// scanUnits 2行目以降のヘッダー行を読み込み、単位行があれば返す
+func (csv *CSVReducer) scanUnits(swc ScanWriteCloser, c *config.Config) ([]string, error) {
+	if c.UnitRow > c.HeaderRows || c.UnitRow == 1 {
+		return nil, fmt.Errorf("UnitRowの指定が不正です。HeaderRows:%d, UnitRow:%d", c.HeaderRows, c.UnitRow)
+	}
+	var units []string
+	for row := 2; row <= c.HeaderRows; row++ {
+		if swc.Scan() == false {
+			if err := swc.Err(); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("CSVのヘッダー行が足りません。HeaderRows:%d, 読み込んだヘッダー行数:%d", c.HeaderRows, row-1)
+		}
+		csv.linenum++
+		if row != c.UnitRow {
+			continue
+		}
+		cells, err := parseRecord(nil, swc.Text(), csv.comma)
+		if err != nil {
+			return nil, fmt.Errorf("csvの単位行が読み込めませんでした。%w", err)
+		}
+		units = cells
+	}
+	return units, nil
+}
+
+// findHeader ヘッダー行を探して返す
+// ヘッダー行より前の行はメタデータとして保持する
+func (csv *CSVReducer) findHeader(swc ScanWriteCloser, c *config.Config) (string, error) {
+	var re *regexp.Regexp
+	if c.HeaderPattern != "" {
+		var err error
+		re, err = regexp.Compile(c.HeaderPattern)
+		if err != nil {
+			return "", fmt.Errorf("HeaderPatternの正規表現が不正です。%w", err)
+		}
+	}
+	preamble := []string{}
+	for swc.Scan() {
+		csv.linenum++
+		line := swc.Text()
+		if csv.isHeader(line, c, re) {
+			csv.metadata = parseMetadata(preamble, c.Delimiter)
+			return line, nil
+		}
+		preamble = append(preamble, line)
+	}
+	if err := swc.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("CSVのヘッダー行が見つかりませんでした。読み込んだ行数:%d", csv.linenum)
+}
+
+func (csv *CSVReducer) isHeader(line string, c *config.Config, re *regexp.Regexp) bool {
+	if csv.linenum <= c.SkipLines {
+		// 読み飛ばす行
+		return false
+	}
+	if re != nil {
+		return re.MatchString(line)
+	}
+	if c.HeaderFields > 0 {
+		comma, err := parseDelimiter(c.Delimiter, line)
+		if err != nil {
+			return false
+		}
+		cells, err := parseRecord(nil, line, comma)
+		return err == nil && len(cells) >= c.HeaderFields
+	}
+	return true
+}
+
+func (csv *CSVReducer) headerString(cells, units []string, cl []config.Column, missings []*missingColumn, derived []config.Derived) (string, error) {
+	titles := make([]string, 0, len(cl))
 	for i, it := range cl {
-		col := int(parseColumn(it.Axis))
-		if col >= csv.hmax {
+		cols, err := findColumns(cells, it)
+		if err != nil {
+			return "", err
+		}
+		if len(cols) == 0 {
 			log.Infow(
-				"設定で指定された列番号が存在しません",
+				"設定で指定された列が存在しません",
 				"設定の列指定", it.Axis,
-				"設定の列指定数値", col,
-				"読み込んだCSVの最右列", formatColumn(uint64(csv.hmax)),
-				"読み込んだCSVの最右列数値", csv.hmax,
+				"設定の列名指定", it.Header,
+				"設定の照合方法", it.Match,
 			)
 			continue
 		}
-		cell := cells[col]
-		if it.AxisTitle != "" {
-			cell = it.AxisTitle
+		if i == 0 {
+			// X軸は1列のみ
+			cols = cols[:1]
 		}
-		csv.bufcolumns[i] = cell
-		csv.columnlist = append(csv.columnlist, col)
-		if i > 0 && it.AxisSecondary {
-			csv.secondaries = append(csv.secondaries, i)
+		for _, col := range cols {
+			if col >= csv.hmax {
+				log.Infow(
+					"設定で指定された列番号が存在しません",
+					"設定の列指定", it.Axis,
+					"設定の列指定数値", col,
+					"読み込んだCSVの最右列", formatColumn(uint64(csv.hmax)),
+					"読み込んだCSVの最右列数値", csv.hmax,
+				)
+				continue
+			}
+			unit := it.Unit
+			if col < len(units) && strings.TrimSpace(units[col]) != "" {
+				unit = strings.TrimSpace(units[col])
+			}
+			f, err := newCellTransform(it, unit)
+			if err != nil {
+				return "", fmt.Errorf("%s列の%w", formatColumn(uint64(col)), err)
+			}
+			if it.ConvertTo != "" {
+				unit = it.ConvertTo
+			}
+			var filter filterFunc
+			if i > 0 && it.Filter != nil {
+				filter, err = newFilter(it.Filter)
+				if err != nil {
+					return "", fmt.Errorf("%s列の%w", formatColumn(uint64(col)), err)
+				}
+			}
+			title := columnTitle(cells[col], unit, it.AxisTitle)
+			titles = csv.appendColumn(titles, title, col, i > 0 && it.AxisSecondary, f, filter, missings[i])
+			if filter != nil && it.Filter.KeepRaw {
+				// フィルタ前の列を隣に追加する
+				titles = csv.appendColumn(titles, title+" (raw)", col, i > 0 && it.AxisSecondary, f, nil, missings[i])
+			}
 		}
 	}
-	return strings.Join(csv.bufcolumns[:len(csv.columnlist)], ",")
+	// 計算で求める列はY列の後ろに追加する
+	for _, it := range derived {
+		f, err := compileExpr(it.Expr, cells, csv.decimal)
+		if err != nil {
+			return "", fmt.Errorf("%sの%w", it.Name, err)
+		}
+		if it.AxisSecondary {
+			csv.secondaries = append(csv.secondaries, len(titles))
+		}
+		titles = append(titles, columnTitle(it.Name, "", it.AxisTitle))
+		csv.derived = append(csv.derived, f)
+	}
+	if len(titles) == 0 {
+		// 以降の統計値と実効値の列はX列があることを前提にする
+		return "", fmt.Errorf("設定で指定された列がCSVに1つもありません。")
+	}
+	if csv.statsOn {
+		csv.stats = newStats(titles[1:])
+	}
+	// 選択した列数に合わせてバッファを確保
+	csv.bufcolumns = make([]string, len(csv.columnlist)+len(csv.derived))
+	csv.bufmissing = make([]bool, len(csv.columnlist))
+	csv.missing = newMissingHandler(csv.missingCols, csv.outX)
+	if csv.rmsColumns {
+		// 実効値の列をY列と同じ順で末尾に追加する
+		n := len(titles) - 1
+		for _, title := range titles[1:] {
+			titles = append(titles, title+" (RMS)")
+		}
+		for _, it := range csv.secondaries {
+			csv.secondaries = append(csv.secondaries, it+n)
+		}
+	}
+	return joinRecord(titles, outComma), nil
 }
 
-func (csv *CSVReducer) scanData(swc ScanWriteCloser) error {
+// appendColumn 出力する列を追加する
+func (csv *CSVReducer) appendColumn(titles []string, title string, col int, secondary bool, f func(string) string, filter filterFunc, mc *missingColumn) []string {
+	if secondary {
+		// 存在しない列を除いた後の位置で指定する
+		csv.secondaries = append(csv.secondaries, len(csv.columnlist))
+	}
+	csv.columnlist = append(csv.columnlist, col)
+	csv.transforms = append(csv.transforms, f)
+	csv.filters = append(csv.filters, filter)
+	csv.missingCols = append(csv.missingCols, mc)
+	if filter != nil {
+		csv.filtered = true
+	}
+	return append(titles, title)
+}
+
+// columnTitle 凡例と軸タイトルに使う列名を返す
+// AxisTitleの指定がある場合はそちらを優先し、{name}を列名、{unit}を単位に置換する
+func columnTitle(name, unit, title string) string {
+	if title != "" {
+		return strings.NewReplacer("{name}", name, "{unit}", unit).Replace(title)
+	}
+	if unit == "" {
+		return name
+	}
+	return name + " [" + unit + "]"
+}
+
+func (csv *CSVReducer) scanData(swc ScanWriteCloser, c *config.Config) error {
 	if csv.linenum <= 0 {
 		return fmt.Errorf("CSVのヘッダーを読み込んでいません。")
 	}
+	emit := func(row []string) {
+		swc.WriteString(joinRecord(row, outComma) + Newline)
+	}
+	if csv.workers > 1 {
+		// 間引き処理の集計と出力する行の文字列化も並列に行う
+		pool := newOutputPool(swc, csv.workers)
+		defer pool.close()
+		emit = pool.emit
+		if csv.reduceAsync != nil {
+			csv.reduceAsync(pool.async)
+		}
+	}
+	process := func(linenum int, row []string) {
+		if csv.filtered {
+			csv.applyFilters(row)
+		}
+		if csv.reduceFunc != nil {
+			csv.reduceFunc(linenum, row, emit)
+		} else {
+			emit(row)
+		}
+	}
+	var err error
+	if csv.workers > 1 {
+		err = csv.scanRowsParallel(swc, c, process)
+	} else {
+		err = csv.scanRows(swc, c, process)
+	}
+	if err != nil {
+		return err
+	}
+	if csv.missing != nil {
+		csv.missing.flush(process)
+	}
+	if csv.flushFunc != nil {
+		// 間引き処理が保持している行の出力
+		csv.flushFunc(emit)
+	}
+	if csv.reduceErr != nil {
+		return csv.reduceErr()
+	}
+	return nil
+}
+
+// scanRows データ行を1行ずつ読み込んで処理する
+func (csv *CSVReducer) scanRows(swc ScanWriteCloser, c *config.Config, process func(linenum int, row []string)) error {
+	for {
+		cells, err := csv.nextRow(swc)
+		if err != nil {
+			return err
+		}
+		if cells == nil {
+			// 結合する次のファイルに続ける
+			ok, err := csv.nextFile(swc, c)
+			if err != nil {
+				return err
+			}
+			if ok {
+				continue
+			}
+			break
+		}
+		if csv.elapsed && !csv.hasOrigin {
+			// 最初の行を経過時間の基準にする
+			if x, ok := csv.rawX(cells); ok {
+				csv.origin, csv.hasOrigin = x, true
+			}
+		}
+		if csv.rowFilter != nil && !csv.rowFilter(cells) {
+			// 条件に合わない行は間引く前に除く
+			continue
+		}
+		row := csv.dataRow(cells)
+		if csv.stats != nil {
+			// 統計値は補間や間引きの前の値で求める
+			csv.updateStats(row, csv.bufmissing)
+		}
+		if csv.missing != nil {
+			// 欠損値の処理（補間する場合は行の出力が遅れる）
+			csv.missing.push(csv.linenum, row, csv.bufmissing, process)
+		} else {
+			process(csv.linenum, row)
+		}
+	}
+	return nil
+}
+
+// nextRow 次のデータ行を読み込む。読み込む行が無い場合はnilを返す
+// 不正な行はOnBadRowの指定に従って処理する
+func (csv *CSVReducer) nextRow(swc ScanWriteCloser) ([]string, error) {
 	for swc.Scan() {
 		csv.linenum++
-		cells := strings.Split(swc.Text(), ",")
-		if len(cells) < csv.hmax-1 {
-			return fmt.Errorf("csvの区切り文字数が最初より少なくなりました。ヘッダーの区切り文字数:%d, %d行目の区切り文字数:%d", csv.hmax, csv.linenum, len(cells))
+		cells, err := parseRecord(csv.bufcells, swc.Text(), csv.comma)
+		csv.bufcells = cells
+		policy, err := csv.checkRow(csv.linenum, cells, err)
+		if err != nil {
+			return nil, err
 		}
-		if csv.reduceFunc != nil && csv.reduceFunc(csv.linenum, cells) {
-			// 間引く行の場合
-		} else {
-			swc.WriteString(csv.dataString(cells) + Newline)
+		if policy != "" {
+			csv.badRows = append(csv.badRows, badRow{file: csv.fileIndex, line: csv.linenum})
+		}
+		switch policy {
+		case badRowSkip:
+			continue
+		case badRowStop:
+			return nil, nil
+		case "":
+			if len(cells) < csv.hmax {
+				csv.paddedRows = append(csv.paddedRows, badRow{file: csv.fileIndex, line: csv.linenum})
+			}
 		}
+		cells = csv.padRow(cells)
+		csv.bufcells = cells
+		return cells, nil
 	}
-	return swc.Err()
+	return nil, swc.Err()
 }
 
-func (csv *CSVReducer) dataString(cells []string) string {
+// checkRow 読み込んだ行を検査する
+// 不正な行の場合は処理方法（"skip" "pad" "stop"）を返し、中断する場合はエラーを返す
+// 最後の1列だけが無い行は末尾の空欄が省略されたものとして不正な行とせず、空欄で補う（padRow）
+// 補った行はpaddedRowsに記録してlogBadRowsで件数を出力する
+func (csv *CSVReducer) checkRow(linenum int, cells []string, err error) (string, error) {
+	if err != nil {
+		err = fmt.Errorf("csvの%d行目が読み込めませんでした。%w", linenum, err)
+	} else if len(cells) < csv.hmax-1 {
+		err = fmt.Errorf("csvの区切り文字数が最初より少なくなりました。ヘッダーの区切り文字数:%d, %d行目の区切り文字数:%d", csv.hmax, linenum, len(cells))
+	}
+	if err == nil {
+		return "", nil
+	}
+	switch csv.onBadRow {
+	case badRowSkip, badRowPad, badRowStop:
+		return csv.onBadRow, nil
+	}
+	return "", err
+}
+
+// padRow 足りない列を空欄で補う
+func (csv *CSVReducer) padRow(cells []string) []string {
+	for len(cells) < csv.hmax {
+		cells = append(cells, "")
+	}
+	return cells
+}
+
+// logBadRows 不正な行と最後の列を空欄で補った行の集計を出力する
+func (csv *CSVReducer) logBadRows() {
+	if len(csv.badRows) > 0 {
+		log.Infow(
+			"不正な行がありました",
+			"処理方法", csv.onBadRow,
+			"行数", len(csv.badRows),
+			"行番号", csv.badRowLines(csv.badRows),
+		)
+	}
+	if len(csv.paddedRows) > 0 {
+		log.Infow(
+			"最後の列が無い行を空欄で補いました",
+			"行数", len(csv.paddedRows),
+			"行番号", csv.badRowLines(csv.paddedRows),
+		)
+	}
+}
+
+// badRowLines ログに出力する行番号（最大maxLogBadRows個）
+func (csv *CSVReducer) badRowLines(rows []badRow) []string {
+	if len(rows) > maxLogBadRows {
+		rows = rows[:maxLogBadRows]
+	}
+	lines := make([]string, 0, len(rows))
+	for _, it := range rows {
+		lines = append(lines, csv.badRowString(it))
+	}
+	return lines
+}
+
+// dataRow 設定で選択された列を取り出し、計算で求める列を追加する
+func (csv *CSVReducer) dataRow(cells []string) []string {
+	csv.selectRow(cells, csv.bufcolumns, csv.bufmissing)
+	return csv.bufcolumns
+}
+
+// selectRow 選択された列と計算で求める列をrowに書き込む
+// missingには欠損値の指定がある列が欠損値かどうかを書き込む
+func (csv *CSVReducer) selectRow(cells, row []string, missing []bool) {
 	for i, it := range csv.columnlist {
-		csv.bufcolumns[i] = cells[it]
+		if mc := csv.missingCols[i]; mc != nil {
+			// 欠損値は変換前の値で判定する
+			missing[i] = mc.match(cells[it])
+		}
+		cell := normalizeDecimal(cells[it], csv.decimal)
+		if i == 0 {
+			// 時刻の変換
+			cell = csv.formatX(cell)
+		}
+		if f := csv.transforms[i]; f != nil {
+			// 係数と単位の変換
+			cell = f(cell)
+		}
+		row[i] = cell
+	}
+	n := len(csv.columnlist)
+	for i, f := range csv.derived {
+		row[n+i] = formatCell(f(cells))
+	}
+}
+
+// applyFilters フィルタを設定した列の値をフィルタ後の値に置き換える
+func (csv *CSVReducer) applyFilters(row []string) {
+	x := math.NaN()
+	if ns, ok := csv.outX(row[0]); ok {
+		x = float64(ns) / float64(time.Second)
+	}
+	for i, f := range csv.filters {
+		if f == nil {
+			continue
+		}
+		if v := parseCell(row[i]); !math.IsNaN(v) {
+			row[i] = formatCell(f(x, v))
+		}
 	}
-	return strings.Join(csv.bufcolumns[:len(csv.columnlist)], ",")
 }
 
 // Go標準ライブラリ[src/strconv/itoa.go formatBits]を参考に改造
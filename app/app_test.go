@@ -1,6 +1,47 @@
 package app
 
-import "testing"
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/tanaton/CSVToExcelGraph/app/config"
+	"github.com/tanaton/CSVToExcelGraph/app/graph"
+)
+
+func init() {
+	UpdateLogger(io.Discard)
+}
+
+// reduceString 文字列のCSVを間引いて結果を文字列で返す
+func reduceString(t *testing.T, c *config.Config, in string) (*CSVReducer, string) {
+	t.Helper()
+	dir := t.TempDir()
+	rp := filepath.Join(dir, "in.csv")
+	wp := filepath.Join(dir, "out.csv")
+	if err := os.WriteFile(rp, []byte(in), 0666); err != nil {
+		t.Fatal(err)
+	}
+	csv, err := reduceCSV(c, rp, wp)
+	if err != nil {
+		t.Fatalf("reduceCSV error = %v", err)
+	}
+	out, err := os.ReadFile(wp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csv, strings.TrimPrefix(string(out), utf8BOM)
+}
 
 func TestFormatColumn(t *testing.T) {
 	data := []struct {
@@ -60,3 +101,1502 @@ func TestParseColumn(t *testing.T) {
 		}
 	}
 }
+
+func TestParseRecord(t *testing.T) {
+	data := []struct {
+		in  string
+		out []string
+		err bool
+	}{
+		{in: "a,b,c", out: []string{"a", "b", "c"}},
+		{in: "", out: []string{""}},
+		{in: "a,,c,", out: []string{"a", "", "c", ""}},
+		{in: `"Temp, inlet [°C]",b`, out: []string{"Temp, inlet [°C]", "b"}},
+		{in: `a,"say ""hi""",c`, out: []string{"a", `say "hi"`, "c"}},
+		{in: "\"multi\r\nline\",2", out: []string{"multi\r\nline", "2"}},
+		{in: `"",x`, out: []string{"", "x"}},
+		{in: `a"b,c`, out: []string{`a"b`, "c"}},
+		{in: `"abc`, err: true},
+		{in: `"abc"d,e`, err: true},
+	}
+	for _, test := range data {
+		out, err := parseRecord(nil, test.in, ',')
+		if test.err {
+			if err == nil {
+				t.Errorf("parseRecord(%q) error = nil want error", test.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRecord(%q) error = %v", test.in, err)
+			continue
+		}
+		if strings.Join(out, "|") != strings.Join(test.out, "|") || len(out) != len(test.out) {
+			t.Errorf("parseRecord(%q) = %q want %q", test.in, out, test.out)
+		}
+	}
+}
+
+func TestJoinRecord(t *testing.T) {
+	data := []struct {
+		in  []string
+		out string
+	}{
+		{in: []string{"a", "b", "c"}, out: "a,b,c"},
+		{in: []string{"Temp, inlet [°C]", "b"}, out: `"Temp, inlet [°C]",b`},
+		{in: []string{`say "hi"`}, out: `"say ""hi"""`},
+		{in: []string{"multi\nline", ""}, out: "\"multi\nline\","},
+	}
+	for _, test := range data {
+		out := joinRecord(test.in, ',')
+		if out != test.out {
+			t.Errorf("joinRecord(%q) = %q want %q", test.in, out, test.out)
+		}
+	}
+}
+
+func TestRecordSplitter(t *testing.T) {
+	data := []struct {
+		comma byte
+		in    string
+		out   []string
+	}{
+		{comma: ',', in: "a,b\r\n1,2\r\n", out: []string{"a,b", "1,2"}},
+		{comma: ',', in: "a,b\n1,2", out: []string{"a,b", "1,2"}},
+		{comma: ',', in: "\"x\r\ny\",b\r\n1,2\r\n", out: []string{"\"x\r\ny\",b", "1,2"}},
+		{comma: ',', in: "\"a\"\"\nb\",c\n", out: []string{"\"a\"\"\nb\",c"}},
+		{comma: ',', in: "1,5\"x\n2,3\n4,5\n", out: []string{"1,5\"x", "2,3", "4,5"}},
+		{comma: ',', in: "a;\"x\n1,2\n", out: []string{"a;\"x", "1,2"}},
+		{comma: ':', in: "a:\"x\ny\"\n1:2\n", out: []string{"a:\"x\ny\"", "1:2"}},
+		// 区切り文字が決まる前は候補の直後をフィールドの先頭とみなす
+		{comma: 0, in: "a\t\"x\ny\"\n1\t2\n", out: []string{"a\t\"x\ny\"", "1\t2"}},
+	}
+	for _, test := range data {
+		sc := bufio.NewScanner(strings.NewReader(test.in))
+		sc.Split((&recordSplitter{comma: test.comma}).split)
+		out := []string{}
+		for sc.Scan() {
+			out = append(out, sc.Text())
+		}
+		if err := sc.Err(); err != nil {
+			t.Errorf("split(%q) error = %v", test.in, err)
+			continue
+		}
+		if strings.Join(out, "|") != strings.Join(test.out, "|") {
+			t.Errorf("split(%q, %q) = %q want %q", test.comma, test.in, out, test.out)
+		}
+	}
+}
+
+func TestParseDelimiter(t *testing.T) {
+	data := []struct {
+		conf   string
+		header string
+		out    byte
+	}{
+		{conf: "", header: "a;b;c", out: ','},
+		{conf: "\t", header: "a,b", out: '\t'},
+		{conf: "semicolon", header: "", out: ';'},
+		{conf: "auto", header: "a,b,c", out: ','},
+		{conf: "auto", header: "a\tb\tc", out: '\t'},
+		{conf: "auto", header: "a;b;\"c,d,e\"", out: ';'},
+		{conf: "auto", header: "a|b|c", out: '|'},
+		{conf: "auto", header: "abc", out: ','},
+	}
+	for _, test := range data {
+		out, err := parseDelimiter(test.conf, test.header)
+		if err != nil || out != test.out {
+			t.Errorf("parseDelimiter(%q, %q) = %q, %v want %q", test.conf, test.header, out, err, test.out)
+		}
+	}
+	if _, err := parseDelimiter("ab", ""); err == nil {
+		t.Errorf("parseDelimiter(%q) error = nil want error", "ab")
+	}
+}
+
+func TestNormalizeDecimal(t *testing.T) {
+	data := []struct {
+		in  string
+		out string
+	}{
+		{in: "1,25", out: "1.25"},
+		{in: "-0,5", out: "-0.5"},
+		{in: "12", out: "12"},
+		{in: "a,b", out: "a,b"},
+		{in: "1,2,3", out: "1,2,3"},
+	}
+	for _, test := range data {
+		out := normalizeDecimal(test.in, ',')
+		if out != test.out {
+			t.Errorf("normalizeDecimal(%q) = %q want %q", test.in, out, test.out)
+		}
+	}
+}
+
+func TestNewDecodeReader(t *testing.T) {
+	data := []struct {
+		enc string
+		in  []byte
+		out string
+	}{
+		{enc: "auto", in: []byte("時刻,温度\r\n"), out: "時刻,温度\r\n"},
+		{enc: "auto", in: []byte("\xEF\xBB\xBFtime,temp\r\n"), out: "time,temp\r\n"},
+		{enc: "auto", in: []byte("\x8E\x9E\x8D\x8F,\x89\xB7\x93x\r\n"), out: "時刻,温度\r\n"},
+		// 日本語でない8ビットの文字コードはWindows-1252とみなす
+		{enc: "auto", in: []byte("Temp\xE9rature,Dur\xE9e\r\n25,\xB10.5\r\n"), out: "Température,Durée\r\n25,±0.5\r\n"},
+		{enc: "auto", in: []byte("caf\xE9,na\xEFve\r\n"), out: "café,naïve\r\n"},
+		{enc: "auto", in: []byte("\xFF\xFEa\x00,\x00b\x00"), out: "a,b"},
+		{enc: "auto", in: []byte("a\x00,\x00b\x00\r\x00\n\x00"), out: "a,b\r\n"},
+		{enc: "shift_jis", in: []byte("\x8E\x9E\x8D\x8F"), out: "時刻"},
+		{enc: "utf-16le", in: []byte("\xFF\xFEa\x00"), out: "a"},
+		{enc: "utf-8", in: []byte("\xEF\xBB\xBFa"), out: "a"},
+	}
+	for _, test := range data {
+		r, err := newDecodeReader(bytes.NewReader(test.in), test.enc)
+		if err != nil {
+			t.Errorf("newDecodeReader(%q) error = %v", test.enc, err)
+			continue
+		}
+		out, err := io.ReadAll(r)
+		if err != nil || string(out) != test.out {
+			t.Errorf("newDecodeReader(%q, %q) = %q, %v want %q", test.enc, test.in, out, err, test.out)
+		}
+	}
+	if _, err := newDecodeReader(bytes.NewReader(nil), "unknown-encoding"); err == nil {
+		t.Errorf("newDecodeReader(%q) error = nil want error", "unknown-encoding")
+	}
+}
+
+func TestReduceCSVQuoted(t *testing.T) {
+	c := &config.Config{
+		XColumn:  config.Column{Axis: "A"},
+		YColumns: []config.Column{{Axis: "C"}},
+	}
+	in := "time,\"Temp, inlet [°C]\",\"Note\"\r\n0,1.5,\"a\r\nb\"\r\n1,2.5,\"x\"\"y\"\r\n"
+	_, out := reduceString(t, c, in)
+	want := "time,Note\r\n0,\"a\r\nb\"\r\n1,\"x\"\"y\"\r\n"
+	if out != want {
+		t.Errorf("reduceCSV = %q want %q", out, want)
+	}
+	// 候補にない区切り文字でも引用符内の改行でレコードを区切らない
+	c.Delimiter = ":"
+	_, out = reduceString(t, c, strings.ReplaceAll(in, ",", ":"))
+	if out != want {
+		t.Errorf("reduceCSV(%q) = %q want %q", c.Delimiter, out, want)
+	}
+}
+
+func TestReduceCSVPreamble(t *testing.T) {
+	in := "Device ID,DL-220\r\nStart: 2024/03/01 12:00\r\nRate=100 Hz\r\n\r\ntime,a,b\r\n0,1,2\r\n"
+	data := []*config.Config{
+		{SkipLines: 4},
+		{HeaderPattern: "^time,"},
+		{HeaderFields: 3},
+	}
+	for _, c := range data {
+		c.XColumn = config.Column{Axis: "A"}
+		c.YColumns = []config.Column{{Axis: "C"}}
+		csv, out := reduceString(t, c, in)
+		if want := "time,b\r\n0,2\r\n"; out != want {
+			t.Errorf("reduceCSV(%+v) = %q want %q", c, out, want)
+		}
+		title := expandTitle("{Device ID} {Start} {Rate} {file}", "run", csv.metadata)
+		if want := "DL-220 2024/03/01 12:00 100 Hz run"; title != want {
+			t.Errorf("expandTitle = %q want %q", title, want)
+		}
+	}
+}
+
+func TestReduceCSVUnitRow(t *testing.T) {
+	c := &config.Config{
+		XColumn:    config.Column{Axis: "A"},
+		YColumns:   []config.Column{{Axis: "B"}, {Axis: "C", AxisTitle: "Motor [{unit}]"}, {Axis: "D"}},
+		HeaderRows: 3,
+		UnitRow:    3,
+	}
+	in := "time,Speed,Torque,Flag\r\nch,1,2,3\r\ns,rpm,Nm,\r\n0,100,5,1\r\n"
+	_, out := reduceString(t, c, in)
+	want := "time [s],Speed [rpm],Motor [Nm],Flag\r\n0,100,5,1\r\n"
+	if out != want {
+		t.Errorf("reduceCSV = %q want %q", out, want)
+	}
+}
+
+func TestReduceCSVWideColumns(t *testing.T) {
+	const width = 600
+	header := make([]string, width)
+	row := make([]string, width)
+	for i := range header {
+		header[i] = "ch" + formatColumn(uint64(i))
+		row[i] = formatColumn(uint64(i))
+	}
+	in := strings.Join(header, ",") + "\r\n" + strings.Join(row, ",") + "\r\n"
+	data := []int{255, 256, 257, 300, width - 1}
+	for _, n := range data {
+		c := &config.Config{XColumn: config.Column{Axis: "A"}}
+		wantHeader := []string{header[0]}
+		wantRow := []string{row[0]}
+		for i := width - n; i < width; i++ {
+			c.YColumns = append(c.YColumns, config.Column{Axis: formatColumn(uint64(i)), AxisSecondary: i%2 == 0})
+			wantHeader = append(wantHeader, header[i])
+			wantRow = append(wantRow, row[i])
+		}
+		csv, out := reduceString(t, c, in)
+		want := strings.Join(wantHeader, ",") + "\r\n" + strings.Join(wantRow, ",") + "\r\n"
+		if out != want {
+			t.Errorf("reduceCSV(%d columns) = %q want %q", n, out, want)
+		}
+		if len(csv.columnlist) != n+1 {
+			t.Errorf("reduceCSV(%d columns) columnlist = %d want %d", n, len(csv.columnlist), n+1)
+		}
+	}
+}
+
+func TestReduceCSVHeaderName(t *testing.T) {
+	c := &config.Config{
+		XColumn: config.Column{Header: "time"},
+		YColumns: []config.Column{
+			{Header: "speed", Match: "ignorecase"},
+			{Header: "^Motor.*Temp$", Match: "regexp", AxisSecondary: true, AxisTitle: "{name} (motor)"},
+			{Header: "missing", Axis: "B"},
+		},
+	}
+	in := "Speed,time,Motor1 Temp,Pump Temp,Motor2 Temp\r\n1,0,20,30,40\r\n"
+	csv, out := reduceString(t, c, in)
+	want := "time,Speed,Motor1 Temp (motor),Motor2 Temp (motor),time\r\n0,1,20,40,0\r\n"
+	if out != want {
+		t.Errorf("reduceCSV = %q want %q", out, want)
+	}
+	if len(csv.secondaries) != 2 || csv.secondaries[0] != 2 || csv.secondaries[1] != 3 {
+		t.Errorf("reduceCSV secondaries = %v want [2 3]", csv.secondaries)
+	}
+}
+
+func TestAxisColumns(t *testing.T) {
+	data := []struct {
+		in  string
+		out []int
+		err bool
+	}{
+		{in: "C", out: []int{2}},
+		{in: "K:N", out: []int{10, 11, 12, 13}},
+		{in: "D:M/3", out: []int{3, 6, 9, 12}},
+		{in: "x:z", out: []int{23, 24, 25}},
+		{in: "Y:AF", out: []int{24, 25, 26, 27, 28, 29}},
+		{in: "AD:AZ", out: []int{29}},
+		{in: "C:A", err: true},
+		{in: "AF:AE", err: true},
+		{in: "K:", err: true},
+		{in: "1:3", err: true},
+		{in: "A:C/0", err: true},
+		{in: "A:C/x", err: true},
+	}
+	for _, test := range data {
+		out, err := axisColumns(test.in, 30)
+		if test.err {
+			if err == nil {
+				t.Errorf("axisColumns(%q) error = nil want error", test.in)
+			}
+			continue
+		}
+		if err != nil || fmt.Sprint(out) != fmt.Sprint(test.out) {
+			t.Errorf("axisColumns(%q) = %v, %v want %v", test.in, out, err, test.out)
+		}
+	}
+}
+
+func TestReduceCSVRows(t *testing.T) {
+	c := &config.Config{
+		XColumn:    config.Column{Axis: "A"},
+		YColumns:   []config.Column{{Axis: "B"}},
+		ReduceRows: 2,
+	}
+	_, out := reduceString(t, c, "x,y\r\n1,10\r\n2,20\r\n3,30\r\n4,40\r\n")
+	if want := "x,y\r\n1,10\r\n3,30\r\n"; out != want {
+		t.Errorf("reduceCSV = %q want %q", out, want)
+	}
+}
+
+func TestReduceCSVLTTB(t *testing.T) {
+	const rows = 1000
+	var b strings.Builder
+	b.WriteString("x,y\r\n")
+	for i := 0; i < rows; i++ {
+		y := 0
+		if i == 503 {
+			// 間引きで消えてはいけない突発値
+			y = 100
+		}
+		fmt.Fprintf(&b, "%d,%d\r\n", i, y)
+	}
+	data := []int{3, 20, 100, rows, rows + 1}
+	for _, points := range data {
+		c := &config.Config{
+			XColumn:      config.Column{Axis: "A"},
+			YColumns:     []config.Column{{Axis: "B"}},
+			ReduceMode:   "lttb",
+			ReducePoints: points,
+		}
+		_, out := reduceString(t, c, b.String())
+		lines := strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")[1:]
+		want := points
+		if points >= rows {
+			want = rows
+		}
+		if len(lines) != want {
+			t.Errorf("reduceCSV(lttb %d) rows = %d want %d", points, len(lines), want)
+		}
+		if lines[0] != "0,0" || lines[len(lines)-1] != fmt.Sprintf("%d,0", rows-1) {
+			t.Errorf("reduceCSV(lttb %d) first = %q last = %q", points, lines[0], lines[len(lines)-1])
+		}
+		if !strings.Contains(out, "\r\n503,100\r\n") {
+			t.Errorf("reduceCSV(lttb %d) dropped the spike", points)
+		}
+	}
+}
+
+func TestReduceCSVMinMax(t *testing.T) {
+	in := "x,a,b\r\n0,1,5\r\n0.5,3,-1\r\n1,2,x\r\n1.5,-4,7\r\n2,6,\r\n"
+	data := []struct {
+		conf config.Config
+		out  string
+	}{
+		{
+			conf: config.Config{ReduceRows: 2},
+			out:  "x,a,b\r\n0,1,5\r\n0.5,3,-1\r\n1,2,x\r\n1.5,-4,7\r\n2,6,\r\n",
+		},
+		{
+			conf: config.Config{ReduceInterval: "1s"},
+			out:  "x,a,b\r\n0,1,5\r\n0.5,3,-1\r\n1,2,x\r\n1.5,-4,7\r\n2,6,\r\n",
+		},
+		{
+			conf: config.Config{ReduceInterval: "2s"},
+			out:  "x,a,b\r\n0.5,3,-1\r\n1.5,-4,7\r\n2,6,\r\n",
+		},
+	}
+	for _, test := range data {
+		c := test.conf
+		c.XColumn = config.Column{Axis: "A"}
+		c.YColumns = []config.Column{{Axis: "B"}, {Axis: "C"}}
+		c.ReduceMode = "minmax"
+		_, out := reduceString(t, &c, in)
+		if out != test.out {
+			t.Errorf("reduceCSV(%+v) = %q want %q", test.conf, out, test.out)
+		}
+	}
+}
+
+func TestReduceCSVMinMaxOrder(t *testing.T) {
+	data := []struct {
+		name string
+		in   string
+		out  string
+	}{
+		// 下降する区間では最大値の行が先になる
+		{name: "falling", in: "x,a\r\n0,5\r\n1,4\r\n2,1\r\n3,2\r\n4,3\r\n5,7\r\n", out: "x,a\r\n0,5\r\n2,1\r\n3,2\r\n5,7\r\n"},
+		// 最小値と最大値が同じ行の場合は1行
+		{name: "single", in: "x,a\r\n0,5\r\n1,4\r\n2,1\r\n3,2\r\n", out: "x,a\r\n0,5\r\n2,1\r\n3,2\r\n"},
+		{name: "flat", in: "x,a\r\n0,3\r\n1,3\r\n2,3\r\n", out: "x,a\r\n0,3\r\n"},
+	}
+	for _, test := range data {
+		c := config.Config{ReduceMode: "minmax", ReduceRows: 3}
+		c.XColumn = config.Column{Axis: "A"}
+		c.YColumns = []config.Column{{Axis: "B"}}
+		_, out := reduceString(t, &c, test.in)
+		if out != test.out {
+			t.Errorf("%s: reduceCSV() = %q want %q", test.name, out, test.out)
+		}
+	}
+}
+
+func TestReduceCSVTimeWindow(t *testing.T) {
+	in := "time,a\r\n" +
+		"2024/03/01 12:00:00.000,1\r\n" +
+		"2024/03/01 12:00:00.050,5\r\n" +
+		"2024/03/01 12:00:00.080,3\r\n" +
+		"2024/03/01 12:00:00.100,2\r\n" +
+		"2024/03/01 12:00:00.300,ERR\r\n" +
+		"2024/03/01 12:00:00.350,8\r\n"
+	data := []struct {
+		aggregate string
+		out       []string
+	}{
+		{aggregate: "first", out: []string{"1", "2", "8"}},
+		{aggregate: "last", out: []string{"3", "2", "8"}},
+		{aggregate: "", out: []string{"3", "2", "8"}},
+		{aggregate: "min", out: []string{"1", "2", "8"}},
+		{aggregate: "max", out: []string{"5", "2", "8"}},
+		{aggregate: "median", out: []string{"3", "2", "8"}},
+	}
+	for _, test := range data {
+		c := &config.Config{
+			XColumn:         config.Column{Axis: "A"},
+			YColumns:        []config.Column{{Axis: "B"}},
+			ReduceMode:      "time",
+			ReduceInterval:  "100ms",
+			ReduceAggregate: test.aggregate,
+		}
+		_, out := reduceString(t, c, in)
+		lines := strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")[1:]
+		got := []string{}
+		xs := []string{}
+		for _, line := range lines {
+			got = append(got, line[strings.IndexByte(line, ',')+1:])
+			xs = append(xs, line[:strings.IndexByte(line, ',')])
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.out) {
+			t.Errorf("reduceCSV(%q) = %v want %v", test.aggregate, got, test.out)
+		}
+		// Xは間隔の区切りの位置
+		if want := "2024/03/01 12:00:00|2024/03/01 12:00:00.1|2024/03/01 12:00:00.3"; strings.Join(xs, "|") != want {
+			t.Errorf("reduceCSV(%q) X = %v want %v", test.aggregate, xs, want)
+		}
+	}
+	// 数値のXも一定の間隔になる
+	c := &config.Config{
+		XColumn:        config.Column{Axis: "A"},
+		YColumns:       []config.Column{{Axis: "B"}},
+		ReduceMode:     "time",
+		ReduceInterval: "1s",
+	}
+	_, out := reduceString(t, c, "x,a\r\n0.3,1\r\n0.9,3\r\n1.7,5\r\n2.1,7\r\n-0.4,9\r\n")
+	if want := "x,a\r\n0,2\r\n1,5\r\n2,7\r\n-1,9\r\n"; out != want {
+		t.Errorf("reduceCSV(numeric) = %q want %q", out, want)
+	}
+}
+
+func TestXNanos(t *testing.T) {
+	data := []struct {
+		a, b string
+		diff int64
+	}{
+		{a: "1.5", b: "3", diff: 1500000000},
+		{a: "0", b: "0.1", diff: 100000000},
+		{a: "2024/03/01 12:00:00.123", b: "2024/03/01 12:00:01.000", diff: 877000000},
+		{a: "2024-03-01T12:00:00Z", b: "2024-03-01T12:01:00Z", diff: 60000000000},
+		{a: "23:59:59", b: "23:59:59.5", diff: 500000000},
+	}
+	for _, test := range data {
+		a, aok := xNanos(test.a)
+		b, bok := xNanos(test.b)
+		if !aok || !bok || b-a != test.diff {
+			t.Errorf("xNanos(%q) - xNanos(%q) = %v want %v", test.b, test.a, b-a, test.diff)
+		}
+	}
+	for _, it := range []string{"abc", "1700000000000", "-1e10", "Inf"} {
+		if _, ok := xNanos(it); ok {
+			t.Errorf("xNanos(%q) ok = true want false", it)
+		}
+	}
+}
+
+func TestReduceCSVTimeWindowOverflow(t *testing.T) {
+	dir := t.TempDir()
+	rp := filepath.Join(dir, "in.csv")
+	in := "ms,v\r\n1700000000000,1\r\n1700000000500,2\r\n1700000001000,3\r\n"
+	if err := os.WriteFile(rp, []byte(in), 0666); err != nil {
+		t.Fatal(err)
+	}
+	c := &config.Config{
+		XColumn:        config.Column{Axis: "A"},
+		YColumns:       []config.Column{{Axis: "B"}},
+		ReduceMode:     "time",
+		ReduceInterval: "1s",
+	}
+	// 秒として扱えない値は1つのグループにまとめずにエラーにする
+	if _, err := reduceCSV(c, rp, filepath.Join(dir, "out.csv")); err == nil {
+		t.Errorf("reduceCSV error = nil want error")
+	}
+	c.XColumn.TimeLayout = "epochms"
+	_, out := reduceString(t, c, in)
+	got := []string{}
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")[1:] {
+		got = append(got, line[strings.IndexByte(line, ',')+1:])
+	}
+	if want := "1.5,3"; strings.Join(got, ",") != want {
+		t.Errorf("reduceCSV = %q want %q", strings.Join(got, ","), want)
+	}
+}
+
+func TestReduceCSVMean(t *testing.T) {
+	in := "x,a,b\r\n0,1,3\r\n1,3,-3\r\n2,-2,4\r\n3,6,-4\r\n4,5,ERR\r\n"
+	data := []struct {
+		rms  bool
+		out  string
+		secs []int
+	}{
+		{rms: false, out: "x,a,b\r\n0.5,2,0\r\n2.5,2,0\r\n4,5,\r\n", secs: []int{2}},
+		{rms: true, out: "x,a,b,a (RMS),b (RMS)\r\n0.5,2,0,2.23606797749979,3\r\n2.5,2,0,4.47213595499958,4\r\n4,5,,5,\r\n", secs: []int{2, 4}},
+	}
+	for _, test := range data {
+		c := &config.Config{
+			XColumn:    config.Column{Axis: "A"},
+			YColumns:   []config.Column{{Axis: "B"}, {Axis: "C", AxisSecondary: true}},
+			ReduceMode: "mean",
+			ReduceRows: 2,
+			ReduceRMS:  test.rms,
+		}
+		csv, out := reduceString(t, c, in)
+		if out != test.out {
+			t.Errorf("reduceCSV(rms %v) = %q want %q", test.rms, out, test.out)
+		}
+		if fmt.Sprint(csv.secondaries) != fmt.Sprint(test.secs) {
+			t.Errorf("reduceCSV(rms %v) secondaries = %v want %v", test.rms, csv.secondaries, test.secs)
+		}
+	}
+}
+
+func TestCompileExpr(t *testing.T) {
+	header := []string{"time", "Voltage", "Current", "P1", "P2", "Temp F"}
+	cells := []string{"0", "12", "1.5", "300", "120", "212"}
+	data := []struct {
+		in  string
+		out float64
+		err bool
+	}{
+		{in: "B*C", out: 18},
+		{in: "[Voltage] * [current]", out: 18},
+		{in: "[P1]-[P2]", out: 180},
+		{in: "([Temp F] - 32) * 5 / 9", out: 100},
+		{in: "-B + 2^3", out: -4},
+		{in: "2^-1", out: 0.5},
+		{in: "sqrt(D - E + 16)", out: 14},
+		{in: "abs(E - D) / 1e2", out: 1.8},
+		{in: "1 + 2 * 3", out: 7},
+		{in: "(1 + 2) * 3", out: 9},
+		{in: "B *", err: true},
+		{in: "[missing]", err: true},
+		{in: "foo(B)", err: true},
+		{in: "(B", err: true},
+		{in: "B C", err: true},
+		{in: "A1", err: true},
+	}
+	for _, test := range data {
+		f, err := compileExpr(test.in, header, '.')
+		if test.err {
+			if err == nil {
+				t.Errorf("compileExpr(%q) error = nil want error", test.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("compileExpr(%q) error = %v", test.in, err)
+			continue
+		}
+		if out := f(cells); math.Abs(out-test.out) > 1e-9 {
+			t.Errorf("compileExpr(%q) = %v want %v", test.in, out, test.out)
+		}
+	}
+}
+
+func TestReduceCSVDerived(t *testing.T) {
+	c := &config.Config{
+		XColumn:  config.Column{Axis: "A"},
+		YColumns: []config.Column{{Axis: "B"}},
+		Derived: []config.Derived{
+			{Name: "Power", Expr: "[V]*[I]", AxisSecondary: true, AxisTitle: "{name} [W]"},
+			{Name: "Ratio", Expr: "B/C"},
+		},
+	}
+	_, out := reduceString(t, c, "t,V,I\r\n0,12,2\r\n1,10,0\r\n2,x,1\r\n")
+	want := "t,V,Power [W],Ratio\r\n0,12,24,6\r\n1,10,0,\r\n2,x,,\r\n"
+	if out != want {
+		t.Errorf("reduceCSV = %q want %q", out, want)
+	}
+}
+
+func TestReduceCSVScaleAndUnit(t *testing.T) {
+	c := &config.Config{
+		XColumn: config.Column{Axis: "A"},
+		YColumns: []config.Column{
+			{Axis: "B", Scale: 0.5, Offset: -1, Precision: 2},
+			{Axis: "C", ConvertTo: "°C", Precision: 1},
+			{Axis: "D", Unit: "psi", ConvertTo: "kPa", Precision: 3},
+		},
+		HeaderRows: 2,
+		UnitRow:    2,
+	}
+	in := "t,raw,temp,press\r\ns,,°F,\r\n0,100,212,1\r\n1,x,32,2\r\n"
+	_, out := reduceString(t, c, in)
+	want := "t [s],raw,temp [°C],press [kPa]\r\n0,49.00,100.0,6.895\r\n1,x,0.0,13.790\r\n"
+	if out != want {
+		t.Errorf("reduceCSV = %q want %q", out, want)
+	}
+	c.YColumns = []config.Column{{Axis: "C", ConvertTo: "kPa"}}
+	dir := t.TempDir()
+	rp := filepath.Join(dir, "in.csv")
+	os.WriteFile(rp, []byte(in), 0666)
+	if _, err := reduceCSV(c, rp, filepath.Join(dir, "out.csv")); err == nil {
+		t.Errorf("reduceCSV(°F -> kPa) error = nil want error")
+	}
+}
+
+func TestFilters(t *testing.T) {
+	in := []float64{1, 2, 3, 100, 5, 6}
+	data := []struct {
+		conf config.ColumnFilter
+		out  []float64
+	}{
+		{conf: config.ColumnFilter{Type: "movingaverage", Window: 3}, out: []float64{1, 1.5, 2, 35, 36, 37}},
+		{conf: config.ColumnFilter{Type: "median", Window: 3}, out: []float64{1, 1.5, 2, 3, 5, 6}},
+		{conf: config.ColumnFilter{Type: "lowpass", Window: 3}, out: []float64{1, 1.5, 2.25, 51.125, 28.0625, 17.03125}},
+		{conf: config.ColumnFilter{Type: "lowpass", Cutoff: 1 / (2 * math.Pi)}, out: []float64{1, 1.5, 2.25, 51.125, 28.0625, 17.03125}},
+	}
+	for _, test := range data {
+		f, err := newFilter(&test.conf)
+		if err != nil {
+			t.Errorf("newFilter(%+v) error = %v", test.conf, err)
+			continue
+		}
+		for i, v := range in {
+			if out := f(float64(i), v); math.Abs(out-test.out[i]) > 1e-9 {
+				t.Errorf("newFilter(%+v)[%d] = %v want %v", test.conf, i, out, test.out[i])
+			}
+		}
+	}
+	// Xが解釈できない場合はWindowの指数移動平均か、フィルタを掛けない
+	for _, test := range []struct {
+		conf config.ColumnFilter
+		out  []float64
+	}{
+		{conf: config.ColumnFilter{Type: "lowpass", Cutoff: 1, Window: 3}, out: []float64{1, 1.5, 2.25, 51.125, 28.0625, 17.03125}},
+		{conf: config.ColumnFilter{Type: "lowpass", Cutoff: 1}, out: in},
+	} {
+		f, _ := newFilter(&test.conf)
+		for i, v := range in {
+			if out := f(math.NaN(), v); math.Abs(out-test.out[i]) > 1e-9 {
+				t.Errorf("newFilter(%+v)[%d] without X = %v want %v", test.conf, i, out, test.out[i])
+			}
+		}
+	}
+	if _, err := newFilter(&config.ColumnFilter{Type: "median"}); err == nil {
+		t.Errorf("newFilter(median without Window) error = nil want error")
+	}
+}
+
+func TestReduceCSVFilterKeepRaw(t *testing.T) {
+	c := &config.Config{
+		XColumn: config.Column{Axis: "A"},
+		YColumns: []config.Column{
+			{Axis: "B", AxisSecondary: true, Filter: &config.ColumnFilter{Type: "movingaverage", Window: 2, KeepRaw: true}},
+			{Axis: "C"},
+		},
+	}
+	csv, out := reduceString(t, c, "x,a,b\r\n0,2,1\r\n1,4,1\r\n2,x,1\r\n3,8,1\r\n")
+	want := "x,a,a (raw),b\r\n0,2,2,1\r\n1,3,4,1\r\n2,x,x,1\r\n3,6,8,1\r\n"
+	if out != want {
+		t.Errorf("reduceCSV = %q want %q", out, want)
+	}
+	if fmt.Sprint(csv.secondaries) != "[1 2]" {
+		t.Errorf("reduceCSV secondaries = %v want [1 2]", csv.secondaries)
+	}
+}
+
+func TestReduceCSVRowFilter(t *testing.T) {
+	in := "t,Mode,v,Tag\r\n100,1,a,idle\r\n120,3,b,run-1\r\n200,3,c,run-2\r\n250,2,d,stop\r\n300,3,e,run-3\r\n301,3,f,run-4\r\n"
+	data := []struct {
+		filter config.RowFilter
+		out    string
+	}{
+		{filter: config.RowFilter{XStart: "120", XEnd: "300"}, out: "b,c,d,e"},
+		{filter: config.RowFilter{XStart: "250"}, out: "d,e,f"},
+		{filter: config.RowFilter{Where: []config.Condition{{Header: "Mode", Op: "==", Value: "3"}}}, out: "b,c,e,f"},
+		{filter: config.RowFilter{Where: []config.Condition{{Axis: "B", Op: "!=", Value: "3.0"}}}, out: "a,d"},
+		{filter: config.RowFilter{Where: []config.Condition{{Axis: "A", Op: "<", Value: "200"}}}, out: "a,b"},
+		{filter: config.RowFilter{Where: []config.Condition{{Axis: "A", Op: ">=", Value: "300"}}}, out: "e,f"},
+		{filter: config.RowFilter{Where: []config.Condition{{Axis: "A", Op: "between", Value: "150", Max: "260"}}}, out: "c,d"},
+		{filter: config.RowFilter{Where: []config.Condition{{Header: "Tag", Op: "regex", Value: "^run-[12]$"}}}, out: "b,c"},
+		{
+			filter: config.RowFilter{
+				XStart: "120", XEnd: "300",
+				Where: []config.Condition{{Header: "Mode", Op: "==", Value: "3"}},
+			},
+			out: "b,c,e",
+		},
+	}
+	for _, test := range data {
+		f := test.filter
+		c := &config.Config{
+			XColumn:  config.Column{Axis: "A"},
+			YColumns: []config.Column{{Axis: "C"}},
+			Filter:   &f,
+		}
+		_, out := reduceString(t, c, in)
+		got := []string{}
+		for _, line := range strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")[1:] {
+			got = append(got, line[strings.IndexByte(line, ',')+1:])
+		}
+		if strings.Join(got, ",") != test.out {
+			t.Errorf("reduceCSV(%+v) = %q want %q", test.filter, strings.Join(got, ","), test.out)
+		}
+	}
+}
+
+func TestReduceCSVElapsed(t *testing.T) {
+	in := "time,state,v\r\n" +
+		"2024/03/01 12:00:00.123,0,1\r\n" +
+		"2024/03/01 12:00:00.623,0,2\r\n" +
+		"2024/03/01 12:00:01.123,1,3\r\n" +
+		"2024/03/01 12:00:03.000,1,4\r\n"
+	data := []struct {
+		x   config.Column
+		out string
+	}{
+		{
+			x:   config.Column{Axis: "A", TimeLayout: "2006/01/02 15:04:05.000", Elapsed: "first"},
+			out: "0,0.5,1,2.877",
+		},
+		{
+			x:   config.Column{Axis: "A", TimeLayout: "%Y/%m/%d %H:%M:%S.%f", Elapsed: "first"},
+			out: "0,0.5,1,2.877",
+		},
+		{
+			x:   config.Column{Axis: "A", Elapsed: "trigger", Trigger: &config.Condition{Header: "state", Op: "==", Value: "1"}},
+			out: "-1,-0.5,0,1.877",
+		},
+		{
+			// Triggerは"trigger"の場合のみ使う
+			x:   config.Column{Axis: "A", Elapsed: "first", Trigger: &config.Condition{Header: "state", Op: "==", Value: "1"}},
+			out: "0,0.5,1,2.877",
+		},
+		{
+			x:   config.Column{Axis: "A", Elapsed: "first", Trigger: &config.Condition{Header: "nothing", Op: "==", Value: "1"}},
+			out: "0,0.5,1,2.877",
+		},
+	}
+	for _, test := range data {
+		c := &config.Config{
+			XColumn:  test.x,
+			YColumns: []config.Column{{Axis: "C"}},
+		}
+		_, out := reduceString(t, c, in)
+		got := []string{}
+		for _, line := range strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")[1:] {
+			got = append(got, line[:strings.IndexByte(line, ',')])
+		}
+		if strings.Join(got, ",") != test.out {
+			t.Errorf("reduceCSV(%+v) = %q want %q", test.x, strings.Join(got, ","), test.out)
+		}
+	}
+}
+
+func TestReduceCSVElapsedWindow(t *testing.T) {
+	c := &config.Config{
+		XColumn:  config.Column{Axis: "A", TimeLayout: "epochms", Elapsed: "first"},
+		YColumns: []config.Column{{Axis: "B"}},
+		Filter:   &config.RowFilter{XStart: "1", XEnd: "2"},
+	}
+	_, out := reduceString(t, c, "ms,v\r\n1700000000000,a\r\n1700000000500,b\r\n1700000001000,c\r\n1700000002000,d\r\n1700000002500,e\r\n")
+	if want := "ms,v\r\n1,c\r\n2,d\r\n"; out != want {
+		t.Errorf("reduceCSV = %q want %q", out, want)
+	}
+}
+
+func TestNewTimeParserRange(t *testing.T) {
+	data := []struct {
+		layout string
+		in     string
+		out    int64
+		ok     bool
+	}{
+		{layout: "epoch", in: "1700000000.5", out: 1700000000500000000, ok: true},
+		{layout: "epochms", in: "1700000000500", out: 1700000000500000000, ok: true},
+		// マイクロ秒のUNIX時間は秒やミリ秒としては範囲外
+		{layout: "epoch", in: "1700000000500000", ok: false},
+		{layout: "epochms", in: "1700000000500000000", ok: false},
+		{layout: "epoch", in: "abc", ok: false},
+	}
+	for _, test := range data {
+		out, ok := newTimeParser(test.layout)(test.in)
+		if ok != test.ok || (ok && out != test.out) {
+			t.Errorf("newTimeParser(%q)(%q) = %v, %v want %v, %v", test.layout, test.in, out, ok, test.out, test.ok)
+		}
+	}
+}
+
+func TestExcelSerial(t *testing.T) {
+	ns, ok := newTimeParser("2006-01-02 15:04:05")("2024-03-01 12:00:00")
+	if !ok {
+		t.Fatalf("newTimeParser parse failed")
+	}
+	if serial := excelSerial(ns); math.Abs(serial-45352.5) > 1e-9 {
+		t.Errorf("excelSerial = %v want %v", serial, 45352.5)
+	}
+	if back := fromExcelSerial(excelSerial(ns)); back != ns {
+		t.Errorf("fromExcelSerial = %v want %v", back, ns)
+	}
+	// 丸め誤差で1つ前の秒にならないこと
+	for _, ms := range []int64{1700000000500, 1700000001000, 1700000001001} {
+		ns := ms * 1000000
+		if back := fromExcelSerial(excelSerial(ns)); back != ns {
+			t.Errorf("fromExcelSerial(excelSerial(%d)) = %v want %v", ns, back, ns)
+		}
+	}
+}
+
+func TestXFormat(t *testing.T) {
+	in := "time,v\r\n2024/03/01 12:00:00,1\r\n2024/03/01 12:00:01,2\r\n"
+	data := []struct {
+		x    config.Column
+		want string
+	}{
+		{x: config.Column{Axis: "A", TimeLayout: "2006/01/02 15:04:05"}, want: xserialFormat},
+		{x: config.Column{Axis: "A", TimeLayout: "2006/01/02 15:04:05", Elapsed: "first"}, want: ""},
+		{x: config.Column{Axis: "A"}, want: ""},
+	}
+	for _, test := range data {
+		c := &config.Config{XColumn: test.x, YColumns: []config.Column{{Axis: "B"}}}
+		csv, _ := reduceString(t, c, in)
+		if got := csv.xFormat(); got != test.want {
+			t.Errorf("xFormat(%+v) = %q want %q", test.x, got, test.want)
+		}
+	}
+}
+
+func TestReduceCSVOnBadRow(t *testing.T) {
+	in := "x,a,b\r\n0,1,2\r\n1,3\r\n2\r\n3,\"5,6\r\n"
+	data := []struct {
+		policy string
+		out    string
+		bad    []badRow
+		padded []badRow
+	}{
+		{policy: "skip", out: "x,b\r\n0,2\r\n1,\r\n", bad: []badRow{{0, 4}, {0, 5}}, padded: []badRow{{0, 3}}},
+		{policy: "pad", out: "x,b\r\n0,2\r\n1,\r\n2,\r\n3,\r\n", bad: []badRow{{0, 4}, {0, 5}}, padded: []badRow{{0, 3}}},
+		{policy: "stop", out: "x,b\r\n0,2\r\n1,\r\n", bad: []badRow{{0, 4}}, padded: []badRow{{0, 3}}},
+	}
+	for _, test := range data {
+		c := &config.Config{
+			XColumn:  config.Column{Axis: "A"},
+			YColumns: []config.Column{{Axis: "C"}},
+			OnBadRow: test.policy,
+		}
+		csv, out := reduceString(t, c, in)
+		if out != test.out {
+			t.Errorf("reduceCSV(%q) = %q want %q", test.policy, out, test.out)
+		}
+		if fmt.Sprint(csv.badRows) != fmt.Sprint(test.bad) {
+			t.Errorf("reduceCSV(%q) badRows = %v want %v", test.policy, csv.badRows, test.bad)
+		}
+		// 最後の列だけが無い行は不正な行とせずに空欄で補い、件数を数える
+		if fmt.Sprint(csv.paddedRows) != fmt.Sprint(test.padded) {
+			t.Errorf("reduceCSV(%q) paddedRows = %v want %v", test.policy, csv.paddedRows, test.padded)
+		}
+	}
+	for _, policy := range []string{"", "error"} {
+		dir := t.TempDir()
+		rp := filepath.Join(dir, "in.csv")
+		os.WriteFile(rp, []byte(in), 0666)
+		c := &config.Config{
+			XColumn:  config.Column{Axis: "A"},
+			YColumns: []config.Column{{Axis: "C"}},
+			OnBadRow: policy,
+		}
+		if _, err := reduceCSV(c, rp, filepath.Join(dir, "out.csv")); err == nil {
+			t.Errorf("reduceCSV(%q) error = nil want error", policy)
+		}
+	}
+}
+
+func TestReduceCSVMissing(t *testing.T) {
+	in := "x,a,b\r\n0,1,10\r\n1,ERR,---\r\n2,NaN,30\r\n3,4,ERR\r\n4,5,\r\n"
+	data := []struct {
+		strategy string
+		out      string
+	}{
+		{strategy: "", out: "x,a,b\r\n0,1,10\r\n1,,\r\n2,,30\r\n3,4,\r\n4,5,\r\n"},
+		{strategy: "blank", out: "x,a,b\r\n0,1,10\r\n1,,\r\n2,,30\r\n3,4,\r\n4,5,\r\n"},
+		{strategy: "previous", out: "x,a,b\r\n0,1,10\r\n1,1,10\r\n2,1,30\r\n3,4,30\r\n4,5,30\r\n"},
+		{strategy: "interpolate", out: "x,a,b\r\n0,1,10\r\n1,2,20\r\n2,3,30\r\n3,4,\r\n4,5,\r\n"},
+		{strategy: "drop", out: "x,a,b\r\n0,1,10\r\n"},
+	}
+	for _, test := range data {
+		c := &config.Config{
+			XColumn:       config.Column{Axis: "A"},
+			YColumns:      []config.Column{{Axis: "B:C"}},
+			MissingValues: []string{"NaN", "---", "ERR", ""},
+			Missing:       test.strategy,
+		}
+		_, out := reduceString(t, c, in)
+		if out != test.out {
+			t.Errorf("reduceCSV(%q) = %q want %q", test.strategy, out, test.out)
+		}
+	}
+	// 列ごとの指定と数値でない値すべての指定
+	c := &config.Config{
+		XColumn: config.Column{Axis: "A"},
+		YColumns: []config.Column{
+			{Axis: "B", MissingValues: []string{"*"}, Missing: "interpolate"},
+			{Axis: "C"},
+		},
+	}
+	_, out := reduceString(t, c, in)
+	if want := "x,a,b\r\n0,1,10\r\n1,2,---\r\n2,3,30\r\n3,4,ERR\r\n4,5,\r\n"; out != want {
+		t.Errorf("reduceCSV() = %q want %q", out, want)
+	}
+	// 補間のために保持した行も元の行番号で間引く
+	c = &config.Config{
+		XColumn:       config.Column{Axis: "A"},
+		YColumns:      []config.Column{{Axis: "B"}},
+		MissingValues: []string{"NaN"},
+		Missing:       "interpolate",
+		ReduceRows:    2,
+	}
+	_, out = reduceString(t, c, "x,a\r\n1,1\r\n2,NaN\r\n3,NaN\r\n4,NaN\r\n5,5\r\n6,6\r\n7,7\r\n")
+	if want := "x,a\r\n1,1\r\n3,3\r\n5,5\r\n7,7\r\n"; out != want {
+		t.Errorf("reduceCSV(ReduceRows) = %q want %q", out, want)
+	}
+	c.Missing = "zero"
+	dir := t.TempDir()
+	rp := filepath.Join(dir, "in.csv")
+	os.WriteFile(rp, []byte(in), 0666)
+	if _, err := reduceCSV(c, rp, filepath.Join(dir, "out.csv")); err == nil {
+		t.Errorf("reduceCSV(%q) error = nil want error", c.Missing)
+	}
+}
+
+func TestReduceCSVMaxLineSize(t *testing.T) {
+	wide := "0" + strings.Repeat(",1.234567890123456", 5000) + "\r\n"
+	in := "x" + strings.Repeat(",y", 5000) + "\r\n" + wide + wide + wide
+	c := &config.Config{
+		XColumn:  config.Column{Axis: "A"},
+		YColumns: []config.Column{{Axis: "B"}},
+	}
+	_, out := reduceString(t, c, in)
+	if want := "x,y\r\n0,1.234567890123456\r\n0,1.234567890123456\r\n0,1.234567890123456\r\n"; out != want {
+		t.Errorf("reduceCSV() = %q want %q", out, want)
+	}
+	c.MaxLineSize = -1
+	if _, out := reduceString(t, c, in); out == "" {
+		t.Errorf("reduceCSV(MaxLineSize:-1) = %q", out)
+	}
+	// 2行目（最初のデータ行）で上限を超える
+	c.MaxLineSize = len(wide) - 10
+	dir := t.TempDir()
+	rp := filepath.Join(dir, "in.csv")
+	os.WriteFile(rp, []byte("x,y\r\n"+wide), 0666)
+	_, err := reduceCSV(c, rp, filepath.Join(dir, "out.csv"))
+	if err == nil || !strings.Contains(err.Error(), "2行目") {
+		t.Errorf("reduceCSV(MaxLineSize:%d) error = %v want line 2", c.MaxLineSize, err)
+	}
+}
+
+func TestCheckExtList(t *testing.T) {
+	data := []struct {
+		list []string
+		out  bool
+	}{
+		{list: []string{"a.csv", "b.CSV"}, out: true},
+		{list: []string{"a.csv.gz", "b.csv.zst", "c.zip"}, out: true},
+		{list: []string{"a.csv", "b.txt"}, out: false},
+		{list: []string{"a.txt.gz"}, out: false},
+		{list: []string{}, out: false},
+	}
+	for _, test := range data {
+		if out := checkExtList(test.list, ".csv", extZip); out != test.out {
+			t.Errorf("checkExtList(%q) = %v want %v", test.list, out, test.out)
+		}
+	}
+}
+
+func TestOutputBase(t *testing.T) {
+	sep := string(filepath.Separator)
+	data := []struct {
+		in   string
+		dir  string
+		base string
+	}{
+		{in: "log" + sep + "data.csv", dir: "log" + sep, base: "data"},
+		{in: "log" + sep + "data.csv.gz", dir: "log" + sep, base: "data"},
+		{in: "log" + sep + "data.csv.zst", dir: "log" + sep, base: "data"},
+		{in: "log" + sep + "day1.zip|sub/a.csv", dir: "log" + sep, base: "day1_a"},
+	}
+	for _, test := range data {
+		dir, base := outputBase(test.in)
+		if dir != test.dir || base != test.base {
+			t.Errorf("outputBase(%q) = %q, %q want %q, %q", test.in, dir, base, test.dir, test.base)
+		}
+	}
+}
+
+func TestReduceCSVCompressed(t *testing.T) {
+	in := "x,a\r\n0,1\r\n1,2\r\n"
+	c := &config.Config{
+		XColumn:  config.Column{Axis: "A"},
+		YColumns: []config.Column{{Axis: "B"}},
+	}
+	dir := t.TempDir()
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte(in))
+	gw.Close()
+	os.WriteFile(filepath.Join(dir, "in.csv.gz"), gz.Bytes(), 0666)
+	var zs bytes.Buffer
+	zw, _ := zstd.NewWriter(&zs)
+	zw.Write([]byte(in))
+	zw.Close()
+	os.WriteFile(filepath.Join(dir, "in.csv.zst"), zs.Bytes(), 0666)
+	var zb bytes.Buffer
+	ar := zip.NewWriter(&zb)
+	for _, name := range []string{"a.csv", "sub/b.CSV", "readme.txt"} {
+		w, _ := ar.Create(name)
+		w.Write([]byte(in))
+	}
+	ar.Close()
+	zp := filepath.Join(dir, "in.zip")
+	os.WriteFile(zp, zb.Bytes(), 0666)
+
+	files, err := expandInputs(c, []string{filepath.Join(dir, "in.csv.gz"), filepath.Join(dir, "in.csv.zst"), zp})
+	if err != nil {
+		t.Fatalf("expandInputs error = %v", err)
+	}
+	want := []string{filepath.Join(dir, "in.csv.gz"), filepath.Join(dir, "in.csv.zst"), zp + "|a.csv", zp + "|sub/b.CSV"}
+	if fmt.Sprint(files) != fmt.Sprint(want) {
+		t.Fatalf("expandInputs() = %q want %q", files, want)
+	}
+	for _, rp := range files {
+		wp := filepath.Join(dir, "out.csv")
+		if _, err := reduceCSV(c, rp, wp); err != nil {
+			t.Errorf("reduceCSV(%q) error = %v", rp, err)
+			continue
+		}
+		out, _ := os.ReadFile(wp)
+		if s := strings.TrimPrefix(string(out), utf8BOM); s != in {
+			t.Errorf("reduceCSV(%q) = %q want %q", rp, s, in)
+		}
+	}
+	c.ZipPattern = "b.*"
+	files, err = expandInputs(c, []string{zp})
+	if err != nil || fmt.Sprint(files) != fmt.Sprint([]string{zp + "|sub/b.CSV"}) {
+		t.Errorf("expandInputs(%q) = %q, %v", c.ZipPattern, files, err)
+	}
+}
+
+func TestReduceFilesJoin(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, in string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(in), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	// 名前順と先頭の時刻順が逆になるファイル
+	a := write("run_001.csv", "#start,2024/01/01 10:00:00\r\nx,a\r\n2024/01/01 10:00:02,3\r\n2024/01/01 10:00:03,4\r\n")
+	b := write("run_002.csv", "#start,2024/01/01 09:00:00\r\nx,a\r\n2024/01/01 10:00:00,1\r\n2024/01/01 10:00:01,2\r\n")
+	bad := write("run_003.csv", "#start,2024/01/01 11:00:00\r\nx,b\r\n2024/01/01 10:00:04,5\r\n")
+	data := []struct {
+		join  string
+		order []string
+		out   string
+	}{
+		{join: "name", order: []string{a, b}, out: "x,a\r\n0,3\r\n1,4\r\n-2,1\r\n-1,2\r\n"},
+		{join: "time", order: []string{b, a}, out: "x,a\r\n0,1\r\n1,2\r\n2,3\r\n3,4\r\n"},
+	}
+	for _, test := range data {
+		c := &config.Config{
+			XColumn:       config.Column{Axis: "A", TimeLayout: "2006/01/02 15:04:05", Elapsed: "first"},
+			YColumns:      []config.Column{{Axis: "B"}},
+			HeaderPattern: "^x,",
+			Join:          test.join,
+		}
+		files, err := orderJoinFiles(c, []string{b, a})
+		if err != nil {
+			t.Fatalf("orderJoinFiles(%q) error = %v", test.join, err)
+		}
+		if fmt.Sprint(files) != fmt.Sprint(test.order) {
+			t.Errorf("orderJoinFiles(%q) = %q want %q", test.join, files, test.order)
+		}
+		wp := filepath.Join(dir, "out.csv")
+		csv, err := reduceFiles(c, files, wp)
+		if err != nil {
+			t.Fatalf("reduceFiles(%q) error = %v", test.join, err)
+		}
+		out, _ := os.ReadFile(wp)
+		if s := strings.TrimPrefix(string(out), utf8BOM); s != test.out {
+			t.Errorf("reduceFiles(%q) = %q want %q", test.join, s, test.out)
+		}
+		if csv.metadata["#start"] != map[string]string{"name": "2024/01/01 10:00:00", "time": "2024/01/01 09:00:00"}[test.join] {
+			t.Errorf("reduceFiles(%q) metadata = %v", test.join, csv.metadata)
+		}
+	}
+	c := &config.Config{
+		XColumn:       config.Column{Axis: "A"},
+		YColumns:      []config.Column{{Axis: "B"}},
+		HeaderPattern: "^x,",
+	}
+	_, err := reduceFiles(c, []string{a, bad}, filepath.Join(dir, "out.csv"))
+	if err == nil || !strings.Contains(err.Error(), "run_003.csv") {
+		t.Errorf("reduceFiles(header mismatch) error = %v want run_003.csv", err)
+	}
+	// 不正な行はファイル名と各ファイルの行番号で示す
+	short := write("run_004.csv", "x,a\r\n2024/01/01 10:00:05,\"5\"x\r\n2024/01/01 10:00:06,6\r\n")
+	c.OnBadRow = "skip"
+	csv, err := reduceFiles(c, []string{a, short}, filepath.Join(dir, "out.csv"))
+	if err != nil {
+		t.Fatalf("reduceFiles(bad row) error = %v", err)
+	}
+	if len(csv.badRows) != 1 || csv.badRowString(csv.badRows[0]) != "run_004.csv:2" {
+		t.Errorf("reduceFiles(bad row) badRows = %v want run_004.csv:2", csv.badRows)
+	}
+	c.Join = "size"
+	if _, err := orderJoinFiles(c, []string{a, b}); err == nil {
+		t.Errorf("orderJoinFiles(%q) error = nil want error", c.Join)
+	}
+}
+
+func TestOverlayCSV(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "run1.csv")
+	b := filepath.Join(dir, "run2.csv.gz")
+	os.WriteFile(a, []byte("x,v,p\r\n0,1,10\r\n1,2,20\r\n2,3,30\r\n"), 0666)
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte("x,v,p\r\n0,4,40\r\n1,\"5\",50\r\n"))
+	gw.Close()
+	os.WriteFile(b, gz.Bytes(), 0666)
+	c := &config.Config{
+		XColumn:  config.Column{Axis: "A"},
+		YColumns: []config.Column{{Axis: "B"}, {Axis: "C", AxisSecondary: true}},
+	}
+	wp := filepath.Join(dir, "out.csv")
+	ov, err := overlayCSV(c, []string{a, b}, wp)
+	if err != nil {
+		t.Fatalf("overlayCSV error = %v", err)
+	}
+	out, _ := os.ReadFile(wp)
+	want := "x,run1: v,run1: p,,x,run2: v,run2: p\r\n" +
+		"0,1,10,,0,4,40\r\n" +
+		"1,2,20,,1,5,50\r\n" +
+		"2,3,30,,,,\r\n"
+	if s := strings.TrimPrefix(string(out), utf8BOM); s != want {
+		t.Errorf("overlayCSV() = %q want %q", s, want)
+	}
+	if fmt.Sprint(ov.secondaries) != "[2 4]" {
+		t.Errorf("overlayCSV() secondaries = %v want [2 4]", ov.secondaries)
+	}
+	if fmt.Sprint(ov.groups) != "[run1:  run2: ]" {
+		t.Errorf("overlayCSV() groups = %q", ov.groups)
+	}
+	if _, err := os.Stat(wp + ".0.tmp"); !os.IsNotExist(err) {
+		t.Errorf("overlayCSV() left temporary file: %v", err)
+	}
+}
+
+func TestReduceCSVStats(t *testing.T) {
+	in := "x,a,b\r\n0,2,x\r\n1,4,\r\n2,-1,\r\n3,3,\r\n"
+	c := &config.Config{
+		XColumn:    config.Column{Axis: "A"},
+		YColumns:   []config.Column{{Axis: "B:C"}},
+		ReduceMode: "rows",
+		ReduceRows: 3,
+		Stats:      true,
+	}
+	csv, out := reduceString(t, c, in)
+	if want := "x,a,b\r\n1,4,\r\n"; out != want {
+		t.Errorf("reduceCSV() = %q want %q", out, want)
+	}
+	if len(csv.stats) != 2 {
+		t.Fatalf("len(stats) = %d want 2", len(csv.stats))
+	}
+	s := csv.stats[0]
+	if s.name != "a" || s.count != 4 || s.min != -1 || s.xAtMin != "2" || s.max != 4 || s.xAtMax != "1" ||
+		s.mean != 2 || s.first != 2 || s.last != 3 {
+		t.Errorf("stats[0] = %+v", *s)
+	}
+	if math.Abs(s.std()-math.Sqrt(3.5)) > 1e-12 || math.Abs(s.rms()-math.Sqrt(7.5)) > 1e-12 {
+		t.Errorf("stats[0] std = %v rms = %v", s.std(), s.rms())
+	}
+	if csv.stats[1].count != 0 {
+		t.Errorf("stats[1].count = %d want 0", csv.stats[1].count)
+	}
+	p := filepath.Join(t.TempDir(), "out_stats.json")
+	if err := writeStatsJSON(p, csv.stats); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := os.ReadFile(p)
+	for _, want := range []string{`"Name": "a"`, `"XAtMin": "2"`, `"Min": -1`, `"RMS": 2.7386127875258306`, `"Name": "b"`} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("writeStatsJSON() = %s want %s", b, want)
+		}
+	}
+	if strings.Count(string(b), `"Min"`) != 1 {
+		t.Errorf("writeStatsJSON() = %s want Min only for a", b)
+	}
+	if rows := statsSheet(csv.stats, ""); len(rows) != 3 || len(rows[1]) != 11 || len(rows[2]) != 2 || rows[1][3] != 2.0 {
+		t.Errorf("statsSheet() = %v", rows)
+	}
+	// シリアル値のXは日時の表示形式で書き込む
+	rows := statsSheet(csv.stats, xserialFormat)
+	for _, col := range []int{3, 5} {
+		if fv, ok := rows[1][col].(graph.FormattedValue); !ok || fv.Format != xserialFormat {
+			t.Errorf("statsSheet(%q)[1][%d] = %#v", xserialFormat, col, rows[1][col])
+		}
+	}
+}
+
+func TestReduceCSVNoColumns(t *testing.T) {
+	dir := t.TempDir()
+	rp := filepath.Join(dir, "in.csv")
+	if err := os.WriteFile(rp, []byte("x,a\r\n0,1\r\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	// 別のファイル用の設定で読み込んだ場合
+	c := &config.Config{
+		XColumn:  config.Column{Header: "time"},
+		YColumns: []config.Column{{Header: "temp"}},
+		Stats:    true,
+	}
+	if _, err := reduceCSV(c, rp, filepath.Join(dir, "out.csv")); err == nil {
+		t.Errorf("reduceCSV error = nil want error")
+	}
+	// 実効値の列を追加する場合
+	c = &config.Config{
+		XColumn:    config.Column{Header: "time"},
+		YColumns:   []config.Column{{Header: "temp"}},
+		ReduceMode: "mean",
+		ReduceRows: 2,
+		ReduceRMS:  true,
+	}
+	if _, err := reduceCSV(c, rp, filepath.Join(dir, "out.csv")); err == nil {
+		t.Errorf("reduceCSV(mean) error = nil want error")
+	}
+}
+
+func TestReduceCSVStatsMissing(t *testing.T) {
+	in := "x,a,b\r\n0,1,1\r\n1,-9999,2\r\n2,3,-9999\r\n3,-9999,4\r\n4,5,5\r\n"
+	for _, strategy := range []string{"interpolate", "previous", "drop"} {
+		c := &config.Config{
+			XColumn:       config.Column{Axis: "A"},
+			YColumns:      []config.Column{{Axis: "B:C"}},
+			MissingValues: []string{"-9999"},
+			Missing:       strategy,
+			Stats:         true,
+		}
+		csv, _ := reduceString(t, c, in)
+		// 補間した値や欠損値そのものは統計値に含めない
+		a, b := csv.stats[0], csv.stats[1]
+		if a.count != 3 || a.min != 1 || a.max != 5 || a.mean != 3 || a.xAtMax != "4" {
+			t.Errorf("%s: stats[0] = %+v", strategy, *a)
+		}
+		if b.count != 4 || b.min != 1 || b.max != 5 || b.mean != 3 {
+			t.Errorf("%s: stats[1] = %+v", strategy, *b)
+		}
+	}
+}
+
+// writeLargeCSV 並列処理の確認用に複数のまとまりに分かれる行数のCSVを作る
+func writeLargeCSV(t testing.TB, p string, lines int, bad bool) {
+	t.Helper()
+	var b strings.Builder
+	b.WriteString("time,a,b,c,d\r\n")
+	for i := 0; i < lines; i++ {
+		sec := 1700000000 + i/10
+		if bad && i%4099 == 4000 {
+			// 列数の足りない行
+			fmt.Fprintf(&b, "%d.%d,1\r\n", sec, i%10)
+			continue
+		}
+		if bad && i%4099 == 2000 {
+			// 最後の列だけが無い行
+			fmt.Fprintf(&b, "%d.%d,%d,%d,%d\r\n", sec, i%10, i%7, i%5, i%3)
+			continue
+		}
+		fmt.Fprintf(&b, "%d.%d,%g,%g,", sec, i%10, math.Sin(float64(i)/50)*100, float64(i%97)/7)
+		switch {
+		case i%31 == 0:
+			b.WriteString("ERR")
+		case i%37 == 0:
+			b.WriteString("\"1,5\"")
+		default:
+			fmt.Fprintf(&b, "%d", i%13)
+		}
+		fmt.Fprintf(&b, ",%d\r\n", i)
+	}
+	if err := os.WriteFile(p, []byte(b.String()), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReduceCSVParallel(t *testing.T) {
+	dir := t.TempDir()
+	rp := filepath.Join(dir, "in.csv")
+	writeLargeCSV(t, rp, 3*parallelChunkLines+123, true)
+	rp2 := filepath.Join(dir, "in2.csv")
+	writeLargeCSV(t, rp2, parallelChunkLines+7, false)
+	ys := []config.Column{{Axis: "B:C"}, {Axis: "D", MissingValues: []string{"ERR"}, Missing: "interpolate"}}
+	data := []struct {
+		name  string
+		files []string
+		c     config.Config
+	}{
+		{name: "pad", files: []string{rp}, c: config.Config{OnBadRow: "pad"}},
+		{name: "skip rows", files: []string{rp}, c: config.Config{OnBadRow: "skip", ReduceRows: 7}},
+		{name: "stop join", files: []string{rp, rp2}, c: config.Config{OnBadRow: "stop", ReduceRows: 3}},
+		{name: "error", files: []string{rp}, c: config.Config{}},
+		{name: "lttb", files: []string{rp2, rp}, c: config.Config{OnBadRow: "skip", ReduceMode: "lttb", ReducePoints: 500}},
+		{name: "minmax", files: []string{rp}, c: config.Config{OnBadRow: "skip", ReduceMode: "minmax", ReduceInterval: "2s"}},
+		{name: "mean", files: []string{rp}, c: config.Config{OnBadRow: "pad", ReduceMode: "mean", ReduceRows: 11, ReduceRMS: true}},
+		{name: "time", files: []string{rp2, rp}, c: config.Config{OnBadRow: "skip", ReduceMode: "time", ReduceInterval: "3s", ReduceAggregate: "median", Stats: true}},
+		{name: "filter", files: []string{rp}, c: config.Config{
+			OnBadRow: "skip",
+			YColumns: []config.Column{{Axis: "B", Filter: &config.ColumnFilter{Type: "lowpass", Cutoff: 0.5, KeepRaw: true}}, {Axis: "C", Scale: 2}},
+			Derived:  []config.Derived{{Name: "sum", Expr: "B+C"}},
+			Filter:   &config.RowFilter{XStart: "100", Where: []config.Condition{{Axis: "C", Op: "<", Value: "10"}}},
+			Stats:    true,
+		}},
+	}
+	for _, test := range data {
+		outs := []string{}
+		bads := []string{}
+		errs := []string{}
+		for _, parallel := range []int{-1, 4} {
+			c := test.c
+			c.XColumn = config.Column{Axis: "A", TimeLayout: "epoch", Elapsed: "first"}
+			if c.YColumns == nil {
+				c.YColumns = ys
+			}
+			c.Parallel = parallel
+			wp := filepath.Join(dir, fmt.Sprintf("out%d.csv", parallel))
+			csv, err := reduceFiles(&c, test.files, wp)
+			errs = append(errs, fmt.Sprint(err))
+			if err != nil {
+				outs = append(outs, "")
+				bads = append(bads, "")
+				continue
+			}
+			out, _ := os.ReadFile(wp)
+			outs = append(outs, string(out))
+			state := fmt.Sprint(csv.badRows, csv.paddedRows, csv.linenum)
+			for _, it := range csv.stats {
+				state += fmt.Sprintf(" %+v", *it)
+			}
+			bads = append(bads, state)
+		}
+		if outs[0] != outs[1] {
+			t.Errorf("%s: parallel output differs (len %d, %d)", test.name, len(outs[0]), len(outs[1]))
+		}
+		if bads[0] != bads[1] {
+			t.Errorf("%s: parallel state = %s want %s", test.name, bads[1], bads[0])
+		}
+		if errs[0] != errs[1] {
+			t.Errorf("%s: parallel error = %s want %s", test.name, errs[1], errs[0])
+		}
+		if test.name == "error" && errs[0] == "<nil>" {
+			t.Errorf("%s: error = nil want error", test.name)
+		}
+	}
+}
+
+func TestReduceCSVParallelLateOrigin(t *testing.T) {
+	dir := t.TempDir()
+	rp := filepath.Join(dir, "in.csv")
+	writeLargeCSV(t, rp, 3*parallelChunkLines, false)
+	b, _ := os.ReadFile(rp)
+	// 経過時間の基準になる行が保持できるまとまりの上限より後にある
+	lines := strings.SplitAfterN(string(b), "\r\n", 2)
+	in := lines[0] + strings.Repeat("-,1,2,3,4\r\n", 2*parallelChunkLines+5) + lines[1]
+	if err := os.WriteFile(rp, []byte(in), 0666); err != nil {
+		t.Fatal(err)
+	}
+	held := parallelMaxHeld
+	parallelMaxHeld = 2
+	defer func() {
+		parallelMaxHeld = held
+	}()
+	outs := []string{}
+	for _, parallel := range []int{-1, 4} {
+		c := &config.Config{
+			XColumn:    config.Column{Axis: "A", TimeLayout: "epoch", Elapsed: "first"},
+			YColumns:   []config.Column{{Axis: "B:E"}},
+			ReduceMode: "mean",
+			ReduceRows: 10,
+			Parallel:   parallel,
+		}
+		wp := filepath.Join(dir, fmt.Sprintf("out%d.csv", parallel))
+		if _, err := reduceCSV(c, rp, wp); err != nil {
+			t.Fatal(err)
+		}
+		out, _ := os.ReadFile(wp)
+		outs = append(outs, string(out))
+	}
+	if outs[0] != outs[1] {
+		t.Errorf("parallel output differs (len %d, %d)", len(outs[0]), len(outs[1]))
+	}
+}
+
+func TestParallelWorkers(t *testing.T) {
+	dir := t.TempDir()
+	rp := filepath.Join(dir, "in.csv")
+	f, err := os.Create(rp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Truncate(parallelMinSize)
+	f.Close()
+	c := &config.Config{}
+	if n := parallelWorkers(c, []string{rp}); n != runtime.NumCPU() {
+		t.Errorf("parallelWorkers() = %d want %d", n, runtime.NumCPU())
+	}
+	// 同時に実行しているグラフ生成の数でCPU数を分け合う
+	activeJobs.Store(int32(runtime.NumCPU()) * 2)
+	defer activeJobs.Store(0)
+	if n := parallelWorkers(c, []string{rp}); n > 1 {
+		t.Errorf("parallelWorkers() = %d want <= 1", n)
+	}
+}
+
+func BenchmarkReduceCSV(b *testing.B) {
+	dir := b.TempDir()
+	rp := filepath.Join(dir, "in.csv")
+	writeLargeCSV(b, rp, 200000, false)
+	fi, _ := os.Stat(rp)
+	for _, parallel := range []int{-1, 2, 4, runtime.NumCPU()} {
+		b.Run(fmt.Sprintf("parallel=%d", parallel), func(b *testing.B) {
+			c := &config.Config{
+				XColumn:    config.Column{Axis: "A", TimeLayout: "epoch", Elapsed: "first"},
+				YColumns:   []config.Column{{Axis: "B:E", Scale: 1.5}},
+				Derived:    []config.Derived{{Name: "sum", Expr: "B+C"}},
+				ReduceMode: "mean",
+				ReduceRows: 10,
+				Parallel:   parallel,
+			}
+			wp := filepath.Join(dir, "out.csv")
+			b.SetBytes(fi.Size())
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := reduceCSV(c, rp, wp); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigLoad(t *testing.T) {
+	dir := t.TempDir()
+	a := `{"XColumn":{"Axis":"A","Trigger":{"Axis":"B","Op":">","Value":"1"}},"YColumns":[{"Axis":"B"}],"Join":"name","Overlay":true,"Stats":true,"Filter":{"XStart":"1"}}`
+	b := `{"XColumn":{"Axis":"A"},"YColumns":[{"Axis":"C"}]}`
+	os.WriteFile(filepath.Join(dir, "a.json"), []byte(a), 0666)
+	os.WriteFile(filepath.Join(dir, "b.json"), []byte(b), 0666)
+	c := config.NewConfig(dir)
+	if err := c.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Stats || c.Join != "name" {
+		t.Fatalf("Load(a.json) = %s", c.Text())
+	}
+	if err := c.SetCurrent("b.json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Load(); err != nil {
+		t.Fatal(err)
+	}
+	// 前の設定の値が残らないこと
+	if c.Stats || c.Overlay || c.Join != "" || c.Filter != nil || c.XColumn.Trigger != nil || c.YColumns[0].Axis != "C" {
+		t.Errorf("Load(b.json) = %s", c.Text())
+	}
+	if got := c.GetNameList(); fmt.Sprint(got) != "[a.json b.json]" {
+		t.Errorf("Load(b.json) GetNameList() = %v want [a.json b.json]", got)
+	}
+}
@@ -0,0 +1,96 @@
+package app
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/tanaton/CSVToExcelGraph/app/config"
+)
+
+// 列名の照合方法
+const (
+	matchExact      = "exact"
+	matchIgnoreCase = "ignorecase"
+	matchRegexp     = "regexp"
+)
+
+// findColumns 設定の列指定に該当する列番号の一覧を返す
+// Headerの指定が無い場合はAxisの列記号で指定する
+func findColumns(cells []string, it config.Column) ([]int, error) {
+	if it.Header == "" {
+		return axisColumns(it.Axis, len(cells))
+	}
+	var match func(string) bool
+	switch strings.ToLower(it.Match) {
+	case "", matchExact:
+		match = func(name string) bool { return name == it.Header }
+	case matchIgnoreCase:
+		match = func(name string) bool { return strings.EqualFold(name, it.Header) }
+	case matchRegexp:
+		re, err := regexp.Compile(it.Header)
+		if err != nil {
+			return nil, fmt.Errorf("列名の正規表現が不正です。Header:%q %w", it.Header, err)
+		}
+		match = re.MatchString
+	default:
+		return nil, fmt.Errorf("列名の照合方法の指定が不正です。Match:%q", it.Match)
+	}
+	cols := []int{}
+	for i, name := range cells {
+		if match(strings.TrimSpace(name)) {
+			cols = append(cols, i)
+		}
+	}
+	if len(cols) == 0 && it.Axis != "" {
+		// 列名が見つからない場合は列記号で指定する
+		return axisColumns(it.Axis, len(cells))
+	}
+	return cols, nil
+}
+
+// axisColumns 列記号から列番号の一覧を返す
+// "K:AF"のような範囲指定と"D:AZ/3"のような間隔指定に対応する
+func axisColumns(axis string, hmax int) ([]int, error) {
+	i := strings.IndexByte(axis, ':')
+	if i < 0 {
+		return []int{int(parseColumn(axis))}, nil
+	}
+	first, last, step := axis[:i], axis[i+1:], "1"
+	if j := strings.IndexByte(last, '/'); j >= 0 {
+		last, step = last[:j], last[j+1:]
+	}
+	if !isColumnName(first) || !isColumnName(last) {
+		return nil, fmt.Errorf("列の範囲指定が不正です。Axis:%q", axis)
+	}
+	n, err := strconv.Atoi(step)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("列の間隔指定が不正です。Axis:%q", axis)
+	}
+	start, end := int(parseColumn(first)), int(parseColumn(last))
+	if start > end {
+		return nil, fmt.Errorf("列の範囲指定の開始が終了より後になっています。Axis:%q", axis)
+	}
+	if end >= hmax {
+		// CSVに存在する列までに制限する
+		end = hmax - 1
+	}
+	cols := []int{}
+	for col := start; col <= end; col += n {
+		cols = append(cols, col)
+	}
+	return cols, nil
+}
+
+func isColumnName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range []byte(s) {
+		if lower(c) < 'a' || 'z' < lower(c) {
+			return false
+		}
+	}
+	return true
+}
@@ -8,15 +8,119 @@ import (
 )
 
 type Column struct {
-	Axis          string
+	Axis          string // "K:AF"のような範囲指定や"D:AZ/3"のような間隔指定も可
+	AxisTitle     string `json:",omitempty"` // {name}は列名、{unit}は単位行の値に置換される
+	AxisSecondary bool   `json:",omitempty"`
+	Header        string `json:",omitempty"` // 列名で指定する場合の列名
+	Match         string `json:",omitempty"` // 列名の照合方法（"exact" "ignorecase" "regexp"、省略時は"exact"）
+	// 値の変換（値*Scale+Offsetを計算した後にUnitからConvertToへ単位を変換する）
+	Scale     float64 `json:",omitempty"` // 省略時は1
+	Offset    float64 `json:",omitempty"`
+	Unit      string  `json:",omitempty"` // 単位行が無い場合の単位
+	ConvertTo string  `json:",omitempty"` // 変換後の単位（"°C" "kPa"など）
+	Precision int     `json:",omitempty"` // 小数点以下の桁数（省略時は必要な桁数）
+	// Y列に掛けるフィルタ
+	Filter *ColumnFilter `json:",omitempty"`
+	// 欠損値の扱い（省略時は全体の指定に従う）
+	MissingValues []string `json:",omitempty"`
+	Missing       string   `json:",omitempty"`
+	// X列の時刻の書式（Goの書式、"%Y/%m/%d %H:%M:%S"のようなstrftime形式、"epoch" "epochms"）
+	TimeLayout string `json:",omitempty"`
+	// X列を経過秒にする場合の基準（"first"は最初の行、"trigger"はTriggerの条件を最初に満たす行）
+	Elapsed string     `json:",omitempty"`
+	Trigger *Condition `json:",omitempty"`
+}
+
+// ColumnFilter Y列に掛けるフィルタ
+type ColumnFilter struct {
+	Type    string  // "movingaverage" "lowpass" "median"
+	Window  int     `json:",omitempty"` // 移動平均と移動中央値の点数（lowpassでCutoff省略時は指数移動平均の点数）
+	Cutoff  float64 `json:",omitempty"` // lowpassのカットオフ周波数[Hz]（X列を秒とみなす、Xが数値や時刻でない行はWindowの指数移動平均）
+	KeepRaw bool    `json:",omitempty"` // フィルタ前の列も残す
+}
+
+// Derived 計算で求める列
+type Derived struct {
+	Name          string
+	Expr          string // "K*L" "[P1]-[P2]"のように列記号か[列名]で列を参照する計算式
 	AxisTitle     string `json:",omitempty"`
 	AxisSecondary bool   `json:",omitempty"`
 }
 
+// RowFilter グラフにする行の絞り込み条件
+type RowFilter struct {
+	XStart string      `json:",omitempty"` // X軸の開始（数値は秒、または時刻）
+	XEnd   string      `json:",omitempty"` // X軸の終了（数値は秒、または時刻）
+	Where  []Condition `json:",omitempty"` // すべて満たす行のみ残す
+}
+
+// Condition 列の値の条件
+type Condition struct {
+	Axis   string `json:",omitempty"`
+	Header string `json:",omitempty"`
+	Match  string `json:",omitempty"`
+	Op     string // "==" "!=" "<" "<=" ">" ">=" "between" "regex"
+	Value  string
+	Max    string `json:",omitempty"` // betweenの上限（下限はValue）
+}
+
 type Config struct {
 	XColumn    Column
 	YColumns   []Column
-	ReduceRows int `json:",omitempty"`
+	Derived    []Derived  `json:",omitempty"`
+	Filter     *RowFilter `json:",omitempty"`
+	ReduceRows int        `json:",omitempty"`
+	// ReduceMode 間引き方法（"rows"はReduceRows行ごとに1行、"lttb"はReducePoints点になるように形状を保って間引く、
+	// "minmax"はReduceRows行またはReduceInterval間隔ごとに各列の最小値と最大値となる行を元の順序で残す、
+	// "time"はReduceInterval間隔ごとにReduceAggregateで集計した1行を区切りの位置のXで出力する、
+	// "mean"はReduceRows行ごとの平均値の1行にする）
+	ReduceMode string `json:",omitempty"`
+	// ReducePoints LTTBで間引いた後の点数
+	ReducePoints int `json:",omitempty"`
+	// ReduceInterval 間引く間隔（"100ms" "1s"など、X列が数値の場合は秒とみなす）
+	ReduceInterval string `json:",omitempty"`
+	// ReduceAggregate 集計方法（"first" "last" "mean" "min" "max" "median"、省略時は"mean"）
+	ReduceAggregate string `json:",omitempty"`
+	// ReduceRMS "mean"で間引く場合に各列の実効値の列を追加する
+	ReduceRMS bool `json:",omitempty"`
+	// Delimiter 区切り文字（"," "\t" ";" "|" または "auto"、省略時は","）
+	Delimiter string `json:",omitempty"`
+	// DecimalSeparator 小数点の文字（","を指定すると"1,25"を"1.25"に変換する）
+	DecimalSeparator string `json:",omitempty"`
+	// Encoding 入力CSVの文字コード（"utf-8" "shift_jis" "utf-16le"など、省略時や"auto"は自動判定）
+	Encoding string `json:",omitempty"`
+	// SkipLines ヘッダー行より前に読み飛ばす行数
+	SkipLines int `json:",omitempty"`
+	// HeaderPattern ヘッダー行とみなす行の正規表現
+	HeaderPattern string `json:",omitempty"`
+	// HeaderFields ヘッダー行とみなす最小の列数
+	HeaderFields int `json:",omitempty"`
+	// HeaderRows ヘッダーの行数（省略時は1行）
+	HeaderRows int `json:",omitempty"`
+	// UnitRow ヘッダー内で単位が書かれている行番号（2以上、省略時は単位無し）
+	UnitRow int `json:",omitempty"`
+	// OnBadRow 列数が足りない行の処理方法（"error"は中断、"skip"は読み飛ばし、"pad"は空欄で補う、"stop"はその行の手前までで終了、省略時は"error"）
+	// 最後の1列だけが無い行は末尾の空欄が省略されたものとして常に空欄で補い、その件数をログに出力する
+	OnBadRow string `json:",omitempty"`
+	// MissingValues 欠損値とみなす値（"NaN" "---" "ERR" ""など、"*"は数値でない値すべて）
+	MissingValues []string `json:",omitempty"`
+	// Missing 欠損値の処理方法（"blank"は空欄にしてグラフを途切れさせる、"previous"は直前の値、
+	// "interpolate"は前後の値から線形補間、"drop"は行を除く、省略時は"blank"）
+	Missing string `json:",omitempty"`
+	// MaxLineSize 1行（引用符内の改行を含む1レコード）の最大バイト数（省略時は16MiB、-1で無制限）
+	MaxLineSize int `json:",omitempty"`
+	// ZipPattern zipファイルからグラフ化するファイル名のパターン（"*.csv" "log_*.csv"など、省略時は"*.csv"）
+	ZipPattern string `json:",omitempty"`
+	// Join 複数のファイルを結合して1つのグラフにする場合の並べ方（"name"はファイル名順、"time"は先頭行のX順、省略時は結合しない）
+	Join string `json:",omitempty"`
+	// Overlay 複数のファイルを1つのグラフに重ねる（凡例にはファイル名を付ける）
+	Overlay bool `json:",omitempty"`
+	// Stats 間引く前のデータから列ごとの統計値を求め、Summaryシートと_stats.jsonに出力する（欠損値は除く）
+	Stats bool `json:",omitempty"`
+	// Parallel 読み込んだ行の解析と間引きの集計を並列で行う数（省略時はファイルの合計が64MiB以上の場合にCPU数を同時に生成するグラフの数で分けた数、-1で並列化しない）
+	Parallel int `json:",omitempty"`
+	// Title グラフのタイトル（{file}はファイル名、{キー}はヘッダー前のメタデータに置換される）
+	Title string `json:",omitempty"`
 
 	cdir     string
 	current  string
@@ -82,7 +186,14 @@ func (c *Config) ReadFile(p string) error {
 	}
 	defer rfp.Close()
 	dec := json.NewDecoder(rfp)
-	return dec.Decode(c)
+	// 前に読み込んだ設定の値が残らないように、設定ファイルの一覧以外は読み込んだ内容で置き換える
+	nc := Config{}
+	if err := dec.Decode(&nc); err != nil {
+		return err
+	}
+	nc.cdir, nc.current, nc.namelist, nc.namemap = c.cdir, c.current, c.namelist, c.namemap
+	*c = nc
+	return nil
 }
 func (c Config) WriteFile(p string) error {
 	wfp, err := os.Create(p)
@@ -0,0 +1,146 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// 文字コード自動判定で先読みするサイズ
+const detectPeekSize = 64 * 1024
+
+// utf8BOM 中間CSVの先頭に付けるBOM（ExcelにUTF-8と認識させるため）
+const utf8BOM = "\ufeff"
+
+// newDecodeReader 指定された文字コードからUTF-8に変換するReaderを生成する
+// nameが空文字または"auto"の場合はBOMと内容から文字コードを推測する
+func newDecodeReader(r io.Reader, name string) (io.Reader, error) {
+	var enc encoding.Encoding
+	switch strings.ToLower(name) {
+	case "", "auto":
+		br := bufio.NewReaderSize(r, detectPeekSize)
+		head, _ := br.Peek(detectPeekSize)
+		enc = detectEncoding(head)
+		r = br
+	case "utf-8", "utf8":
+		enc = unicode.UTF8BOM
+	case "shift_jis", "shift-jis", "sjis", "cp932", "windows-31j":
+		enc = japanese.ShiftJIS
+	case "euc-jp", "eucjp":
+		enc = japanese.EUCJP
+	case "utf-16", "utf-16le", "utf16le":
+		enc = unicode.UTF16(unicode.LittleEndian, unicode.UseBOM)
+	case "utf-16be", "utf16be":
+		enc = unicode.UTF16(unicode.BigEndian, unicode.UseBOM)
+	default:
+		e, err := htmlindex.Get(name)
+		if err != nil {
+			return nil, fmt.Errorf("文字コードの指定が不正です。Encoding:%q", name)
+		}
+		enc = e
+	}
+	return transform.NewReader(r, enc.NewDecoder()), nil
+}
+
+// detectEncoding 先頭のバイト列から文字コードを推測する
+func detectEncoding(head []byte) encoding.Encoding {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xEF, 0xBB, 0xBF}):
+		return unicode.UTF8BOM
+	case bytes.HasPrefix(head, []byte{0xFF, 0xFE}):
+		return unicode.UTF16(unicode.LittleEndian, unicode.UseBOM)
+	case bytes.HasPrefix(head, []byte{0xFE, 0xFF}):
+		return unicode.UTF16(unicode.BigEndian, unicode.UseBOM)
+	}
+	// BOM無しUTF-16はASCII文字の片側が0になる
+	var even, odd int
+	for i, c := range head {
+		if c != 0 {
+			continue
+		}
+		if i%2 == 0 {
+			even++
+		} else {
+			odd++
+		}
+	}
+	if n := len(head) / 2; n > 0 {
+		if odd > n/2 && even*4 < odd {
+			return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+		}
+		if even > n/2 && odd*4 < even {
+			return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+		}
+	}
+	// 先読みの境界で途切れた文字は判定から除く
+	if utf8.Valid(trimPartialRune(head)) {
+		return unicode.UTF8BOM
+	}
+	// UTF-8として不正な場合はShift_JISとして正しく、2バイト文字を含む場合のみShift_JISとみなす
+	if looksShiftJIS(head) {
+		return japanese.ShiftJIS
+	}
+	// それ以外は欧文で一般的なWindows-1252とみなす（ASCII部分はそのまま）
+	return charmap.Windows1252
+}
+
+// looksShiftJIS Shift_JISとして解釈できるかを判定する
+// 2バイト文字を含まない場合や、上位バイトが漢字第2水準以降（0xE0以上）に偏る場合は
+// アクセント付きの文字を含む欧文の可能性が高いのでfalseを返す
+func looksShiftJIS(b []byte) bool {
+	var low, high int
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case c < 0x80, 0xA1 <= c && c <= 0xDF:
+			// ASCIIと半角カナ
+			continue
+		case 0x81 <= c && c <= 0x9F, 0xE0 <= c && c <= 0xFC:
+		default:
+			return false
+		}
+		if i+1 >= len(b) {
+			// 先読みの境界で途切れた文字は判定から除く
+			break
+		}
+		t := b[i+1]
+		if t < 0x40 || t == 0x7F || t > 0xFC {
+			return false
+		}
+		if c <= 0x9F {
+			low++
+		} else {
+			high++
+		}
+		i++
+	}
+	return low > 0 && low >= high
+}
+
+// trimPartialRune 末尾の不完全なUTF-8文字を取り除く
+func trimPartialRune(b []byte) []byte {
+	for i := 1; i < utf8.UTFMax && i <= len(b); i++ {
+		c := b[len(b)-i]
+		if c < utf8.RuneSelf {
+			// ASCII文字で終わっている
+			return b
+		}
+		if utf8.RuneStart(c) {
+			if !utf8.FullRune(b[len(b)-i:]) {
+				return b[:len(b)-i]
+			}
+			return b
+		}
+	}
+	return b
+}
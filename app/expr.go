@@ -0,0 +1,241 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// exprFunc 1行分のセルから計算結果を返す
+type exprFunc func(cells []string) float64
+
+// 計算式で使える関数
+var exprFuncs = map[string]func(float64) float64{
+	"abs":   math.Abs,
+	"sqrt":  math.Sqrt,
+	"exp":   math.Exp,
+	"log":   math.Log,
+	"log10": math.Log10,
+	"sin":   math.Sin,
+	"cos":   math.Cos,
+}
+
+// exprParser 計算式の構文解析用
+// 列は"K"のような列記号か"[Voltage]"のような列名で参照する
+type exprParser struct {
+	src     string
+	pos     int
+	header  []string
+	decimal byte
+}
+
+// compileExpr 計算式を解析して計算用の関数を返す
+func compileExpr(src string, header []string, decimal byte) (exprFunc, error) {
+	p := &exprParser{src: src, header: header, decimal: decimal}
+	f, err := p.parseSum()
+	if err != nil {
+		return nil, fmt.Errorf("計算式が不正です。Expr:%q %w", src, err)
+	}
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return nil, fmt.Errorf("計算式が不正です。Expr:%q %d文字目:%q", src, p.pos+1, p.src[p.pos:])
+	}
+	return f, nil
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// peek 空白を飛ばして次の文字を返す
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+// sum = product {("+" | "-") product}
+func (p *exprParser) parseSum() (exprFunc, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == '+' {
+			left = func(cells []string) float64 { return l(cells) + right(cells) }
+		} else {
+			left = func(cells []string) float64 { return l(cells) - right(cells) }
+		}
+	}
+}
+
+// product = unary {("*" | "/") unary}
+func (p *exprParser) parseProduct() (exprFunc, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == '*' {
+			left = func(cells []string) float64 { return l(cells) * right(cells) }
+		} else {
+			left = func(cells []string) float64 { return l(cells) / right(cells) }
+		}
+	}
+}
+
+// unary = "-" unary | power
+func (p *exprParser) parseUnary() (exprFunc, error) {
+	if p.peek() == '-' {
+		p.pos++
+		f, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(cells []string) float64 { return -f(cells) }, nil
+	}
+	return p.parsePower()
+}
+
+// power = primary ["^" unary]
+func (p *exprParser) parsePower() (exprFunc, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != '^' {
+		return base, nil
+	}
+	p.pos++
+	exp, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return func(cells []string) float64 { return math.Pow(base(cells), exp(cells)) }, nil
+}
+
+// primary = number | column | "[" name "]" | func "(" sum ")" | "(" sum ")"
+func (p *exprParser) parsePrimary() (exprFunc, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		f, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("括弧が閉じられていません。")
+		}
+		p.pos++
+		return f, nil
+	case c == '[':
+		end := strings.IndexByte(p.src[p.pos:], ']')
+		if end < 0 {
+			return nil, fmt.Errorf("列名の括弧が閉じられていません。")
+		}
+		name := p.src[p.pos+1 : p.pos+end]
+		p.pos += end + 1
+		col := p.findHeader(name)
+		if col < 0 {
+			return nil, fmt.Errorf("列名が見つかりません。列名:%q", name)
+		}
+		return p.column(col), nil
+	case '0' <= c && c <= '9' || c == '.':
+		start := p.pos
+		for p.pos < len(p.src) && strings.IndexByte("0123456789.eE", p.src[p.pos]) >= 0 {
+			if (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') && p.pos+1 < len(p.src) && (p.src[p.pos+1] == '-' || p.src[p.pos+1] == '+') {
+				p.pos++
+			}
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("数値が不正です。%q", p.src[start:p.pos])
+		}
+		return func([]string) float64 { return v }, nil
+	case 'a' <= lower(c) && lower(c) <= 'z':
+		start := p.pos
+		for p.pos < len(p.src) && isIdentByte(p.src[p.pos]) {
+			p.pos++
+		}
+		ident := p.src[start:p.pos]
+		if p.peek() == '(' {
+			fn, ok := exprFuncs[strings.ToLower(ident)]
+			if !ok {
+				return nil, fmt.Errorf("関数が見つかりません。関数名:%q", ident)
+			}
+			p.pos++
+			arg, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			if p.peek() != ')' {
+				return nil, fmt.Errorf("関数の括弧が閉じられていません。")
+			}
+			p.pos++
+			return func(cells []string) float64 { return fn(arg(cells)) }, nil
+		}
+		if !isColumnName(ident) {
+			return nil, fmt.Errorf("列記号が不正です。%q", ident)
+		}
+		return p.column(int(parseColumn(ident))), nil
+	case c == 0:
+		return nil, fmt.Errorf("計算式が途中で終わっています。")
+	}
+	return nil, fmt.Errorf("%d文字目の%qが解釈できません。", p.pos+1, c)
+}
+
+func (p *exprParser) findHeader(name string) int {
+	for i, it := range p.header {
+		if strings.TrimSpace(it) == name {
+			return i
+		}
+	}
+	for i, it := range p.header {
+		if strings.EqualFold(strings.TrimSpace(it), name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// column col列目の値を返す関数。数値でない場合はNaNとなる
+func (p *exprParser) column(col int) exprFunc {
+	decimal := p.decimal
+	return func(cells []string) float64 {
+		if col >= len(cells) {
+			return math.NaN()
+		}
+		return parseCell(normalizeDecimal(cells[col], decimal))
+	}
+}
+
+func isIdentByte(c byte) bool {
+	return 'a' <= lower(c) && lower(c) <= 'z' || '0' <= c && c <= '9' || c == '_'
+}
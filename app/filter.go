@@ -0,0 +1,131 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/tanaton/CSVToExcelGraph/app/config"
+)
+
+// フィルタの種類
+const (
+	filterMovingAverage = "movingaverage"
+	filterLowPass       = "lowpass"
+	filterMedian        = "median"
+)
+
+// filterFunc 1点ずつ値を受け取りフィルタ後の値を返す
+// xは秒単位のX（解釈できない場合はNaN）
+type filterFunc func(x, v float64) float64
+
+// newFilter 列のフィルタ設定からフィルタを生成する
+func newFilter(f *config.ColumnFilter) (filterFunc, error) {
+	switch strings.ToLower(f.Type) {
+	case filterMovingAverage:
+		if f.Window <= 0 {
+			return nil, fmt.Errorf("移動平均のWindowには1以上を指定してください。Window:%d", f.Window)
+		}
+		return movingAverage(f.Window), nil
+	case filterMedian:
+		if f.Window <= 0 {
+			return nil, fmt.Errorf("移動中央値のWindowには1以上を指定してください。Window:%d", f.Window)
+		}
+		return movingMedian(f.Window), nil
+	case filterLowPass:
+		if f.Cutoff <= 0 && f.Window <= 0 {
+			return nil, fmt.Errorf("ローパスフィルタにはCutoffかWindowの指定が必要です。")
+		}
+		return lowPass(f.Cutoff, f.Window), nil
+	}
+	return nil, fmt.Errorf("フィルタの種類の指定が不正です。Type:%q", f.Type)
+}
+
+// movingAverage 直近window点の平均
+func movingAverage(window int) filterFunc {
+	ring := make([]float64, window)
+	n, pos := 0, 0
+	sum := 0.0
+	return func(_, v float64) float64 {
+		if n == window {
+			sum -= ring[pos]
+		} else {
+			n++
+		}
+		ring[pos] = v
+		sum += v
+		pos = (pos + 1) % window
+		return sum / float64(n)
+	}
+}
+
+// movingMedian 直近window点の中央値
+func movingMedian(window int) filterFunc {
+	ring := make([]float64, 0, window)
+	sorted := make([]float64, 0, window)
+	pos := 0
+	return func(_, v float64) float64 {
+		if len(ring) < window {
+			ring = append(ring, v)
+		} else {
+			// 一番古い値を取り除く
+			old := ring[pos]
+			i := sort.SearchFloat64s(sorted, old)
+			sorted = append(sorted[:i], sorted[i+1:]...)
+			ring[pos] = v
+			pos = (pos + 1) % window
+		}
+		i := sort.SearchFloat64s(sorted, v)
+		sorted = append(sorted, 0)
+		copy(sorted[i+1:], sorted[i:])
+		sorted[i] = v
+		n := len(sorted)
+		if n%2 == 1 {
+			return sorted[n/2]
+		}
+		return (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+}
+
+// lowPass 1次IIRローパスフィルタ
+// cutoff[Hz]の指定がある場合はXの間隔から係数を求め、無い場合はwindow点の指数移動平均とする
+// Xが数値や時刻として解釈できない場合は、windowの指定があれば指数移動平均、無ければフィルタを掛けない
+func lowPass(cutoff float64, window int) filterFunc {
+	rc := 1 / (2 * math.Pi * cutoff)
+	fixed := 2 / (float64(window) + 1)
+	started := false
+	warned := false
+	prevx, y := 0.0, 0.0
+	return func(x, v float64) float64 {
+		if !started {
+			started = true
+			prevx, y = x, v
+			return y
+		}
+		alpha := fixed
+		if cutoff > 0 {
+			dt := x - prevx
+			prevx = x
+			switch {
+			case math.IsNaN(dt):
+				if !warned {
+					warned = true
+					log.Infow("X列が数値や時刻として解釈できないため、ローパスフィルタのCutoffを使えません。", "Window", window)
+				}
+				if window <= 0 {
+					y = v
+					return y
+				}
+			case dt <= 0:
+				// 同じXが続く場合は値を保持する
+				return y
+			default:
+				alpha = dt / (rc + dt)
+			}
+		}
+		prevx = x
+		y += alpha * (v - y)
+		return y
+	}
+}
@@ -14,6 +14,12 @@ type ExcelGraph struct {
 	obj *excel.Application
 }
 
+// FormattedValue 表示形式を指定して表に書き込む値
+type FormattedValue struct {
+	Value  interface{}
+	Format string
+}
+
 type GraphItem struct {
 	x     int
 	count int
@@ -91,7 +97,9 @@ func (ex *ExcelGraph) getGraphRange(sheet *excel.Worksheet) (string, []GraphItem
 }
 
 // シートからグラフを作る
-func (ex *ExcelGraph) sheetToChart(g *excel.ChartObject, sheet *excel.Worksheet, secondary []int) {
+// groupsは空の列で区切られた列のまとまりごとの凡例の接頭辞（軸タイトルでは除く）
+// xformatはX列とX軸の目盛ラベルの表示形式（空の場合は設定しない）
+func (ex *ExcelGraph) sheetToChart(g *excel.ChartObject, sheet *excel.Worksheet, secondary []int, groups []string, xformat string) {
 	j := 1
 	xname, arr := ex.getGraphRange(sheet)
 	if len(arr) <= 0 {
@@ -120,17 +128,25 @@ func (ex *ExcelGraph) sheetToChart(g *excel.ChartObject, sheet *excel.Worksheet,
 	legend := chart.GetLegend()
 	legend.SetPosition(excel.XlLegendPositionBottom)
 	// 要素の設定
-	for _, it := range arr {
+	for b, it := range arr {
+		if xformat != "" {
+			// X列の表示形式
+			sheet.GetColumns().GetItem(it.x).SetNumberFormat(xformat)
+		}
 		xcell := sheet.GetCells().GetItem(2, it.x)
 		for k := 1; k <= it.count; k++ {
 			// 線ごとにX軸の設定
 			sc := chart.SeriesCollection().Item(j)
+			name := it.leg[k-1]
+			if b < len(groups) {
+				name = strings.TrimPrefix(name, groups[b])
+			}
 			if _, ok := sec[j]; ok {
 				// 2軸
 				sc.SetAxisGroup(excel.XlSecondary)
-				secname = append(secname, it.leg[k-1])
+				secname = appendName(secname, name)
 			} else {
-				priname = append(priname, it.leg[k-1])
+				priname = appendName(priname, name)
 			}
 			end := xcell.GetEnd(excel.XlDown)
 			rg := sheet.GetRange(xcell, end)
@@ -139,15 +155,25 @@ func (ex *ExcelGraph) sheetToChart(g *excel.ChartObject, sheet *excel.Worksheet,
 		}
 	}
 	// グラフの軸についての設定
-	ex.setGraphAxis(g, xname, strings.Join(priname, " / "))
+	ex.setGraphAxis(g, xname, strings.Join(priname, " / "), xformat)
 	// 指定した要素を第二軸へ移動
 	if len(secondary) > 0 {
 		ex.setGraphAxisSecondary(g, strings.Join(secname, " / "))
 	}
 }
 
+// appendName 軸タイトルに使う名前を重複しないように追加する
+func appendName(list []string, name string) []string {
+	for _, it := range list {
+		if it == name {
+			return list
+		}
+	}
+	return append(list, name)
+}
+
 // グラフの軸を設定
-func (ex *ExcelGraph) setGraphAxis(g *excel.ChartObject, xname, yname string) {
+func (ex *ExcelGraph) setGraphAxis(g *excel.ChartObject, xname, yname, xformat string) {
 	chart := g.GetChart()
 	cp := chart.Axes(excel.XlCategory, excel.XlPrimary)
 	vp := chart.Axes(excel.XlValue, excel.XlPrimary)
@@ -159,6 +185,10 @@ func (ex *ExcelGraph) setGraphAxis(g *excel.ChartObject, xname, yname string) {
 	vp.SetHasMinorGridlines(true)
 	// 目盛線の位置を下に移動
 	cp.SetTickLabelPosition(excel.XlTickLabelPositionLow)
+	if xformat != "" {
+		// X軸の目盛ラベルの表示形式
+		cp.GetTickLabels().SetNumberFormat(xformat)
+	}
 	// X軸ラベルを表示
 	cp.SetHasTitle(true)
 	cp.GetAxisTitle().SetText(xname)
@@ -198,6 +228,23 @@ func (ex *ExcelGraph) moveNewGraphSheet(g *excel.ChartObject, name string) *exce
 	return chart.Location(excel.XlLocationAsNewSheet, name)
 }
 
+// 表を新しいシートに書き込む
+func (ex *ExcelGraph) writeSummarySheet(book *excel.Workbook, rows [][]interface{}) {
+	sheet := book.GetWorksheets().Add()
+	sheet.SetName("Summary")
+	cells := sheet.GetCells()
+	for r, row := range rows {
+		for c, v := range row {
+			cell := cells.GetItem(r+1, c+1)
+			if fv, ok := v.(FormattedValue); ok {
+				cell.SetNumberFormat(fv.Format)
+				v = fv.Value
+			}
+			cell.SetValue(v)
+		}
+	}
+}
+
 // スクリーン更新停止
 func (ex *ExcelGraph) lockScreen() {
 	ex.obj.SetScreenUpdating(false)
@@ -208,7 +255,12 @@ func (ex *ExcelGraph) unlockScreen() {
 	ex.obj.SetScreenUpdating(true)
 }
 
-func Excelgraph(rp, wp, ip string, secondary []int) (err error) {
+// Excelgraph 中間CSVからグラフを生成してブックと画像を保存する
+// 空の列で区切られた列のまとまりはそれぞれのX列を持つ系列として描画し、
+// groupsにまとまりごとの凡例の接頭辞を指定すると軸タイトルからは除く
+// summaryを指定するとSummaryシートに表として書き込む（FormattedValueの値はその表示形式にする）
+// xformatを指定するとX列とX軸の目盛ラベルをその表示形式にする
+func Excelgraph(rp, wp, ip, title string, secondary []int, groups []string, summary [][]interface{}, xformat string) (err error) {
 	// COMの初期化
 	ole.CoInitializeEx(0, ole.COINIT_APARTMENTTHREADED|ole.COINIT_DISABLE_OLE1DDE)
 	// 確実に行う必要があるため
@@ -234,12 +286,19 @@ func Excelgraph(rp, wp, ip string, secondary []int) (err error) {
 	// 空グラフの生成
 	graph := ex.createChartObject(sheet, 30, 30, 500, 300, "csvexcelgraph")
 	// シート内容をグラフに変換
-	ex.sheetToChart(graph, sheet, secondary)
+	ex.sheetToChart(graph, sheet, secondary, groups, xformat)
 	// タイトルを設定
-	_, name := filepath.Split(rp)
-	ex.setGraphTitle(graph, strings.TrimSuffix(name, filepath.Ext(name)))
+	if title == "" {
+		_, name := filepath.Split(rp)
+		title = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	ex.setGraphTitle(graph, title)
 	// グラフオブジェクトをグラフシートに移動
 	chart := ex.moveNewGraphSheet(graph, "Graph1")
+	if len(summary) > 0 {
+		// 統計値のシートを追加
+		ex.writeSummarySheet(book, summary)
+	}
 	ex.unlockScreen()
 
 	if ip != "" {
@@ -0,0 +1,184 @@
+package app
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/tanaton/CSVToExcelGraph/app/config"
+)
+
+// 圧縮ファイルの拡張子
+const (
+	extGzip = ".gz"
+	extZstd = ".zst"
+	extZip  = ".zip"
+)
+
+// zipEntrySep zipファイルのパスと中のCSVファイル名の区切り（Windowsのファイル名に使えない文字）
+const zipEntrySep = "|"
+
+// ZipPattern省略時にzipファイルから取り出すファイル名
+const defaultZipPattern = "*.csv"
+
+// inputExt 圧縮の拡張子を除いた拡張子を小文字で返す（"a.csv.gz"は".csv"）
+func inputExt(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == extGzip || ext == extZstd {
+		ext = strings.ToLower(filepath.Ext(strings.TrimSuffix(name, filepath.Ext(name))))
+	}
+	return ext
+}
+
+// splitZipEntry zipファイル内のCSVを指すパスをzipファイルのパスとファイル名に分ける
+func splitZipEntry(rp string) (archive, entry string, ok bool) {
+	i := strings.LastIndex(rp, zipEntrySep)
+	if i < 0 {
+		return rp, "", false
+	}
+	return rp[:i], rp[i+len(zipEntrySep):], true
+}
+
+// outputBase 出力ファイルを置くフォルダと拡張子を除いたファイル名を返す
+// zipファイル内のCSVは"zipファイル名_CSVファイル名"とする
+func outputBase(rp string) (dir, base string) {
+	archive, entry, ok := splitZipEntry(rp)
+	if ok {
+		dir, name := filepath.Split(archive)
+		entry = path.Base(entry)
+		return dir, strings.TrimSuffix(name, filepath.Ext(name)) + "_" + trimInputExt(entry)
+	}
+	dir, name := filepath.Split(rp)
+	return dir, trimInputExt(name)
+}
+
+// trimInputExt 圧縮の拡張子も含めて拡張子を取り除く
+func trimInputExt(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case extGzip, extZstd:
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// expandInputs zipファイルを中のCSVファイルごとのパスに展開する
+func expandInputs(c *config.Config, files []string) ([]string, error) {
+	list := make([]string, 0, len(files))
+	for _, file := range files {
+		if strings.ToLower(filepath.Ext(file)) != extZip {
+			list = append(list, file)
+			continue
+		}
+		entries, err := zipEntries(file, c.ZipPattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			log.Infow("zipファイル内にグラフ化するCSVファイルがありません。", "path", file, "ZipPattern", c.ZipPattern)
+		}
+		for _, it := range entries {
+			list = append(list, file+zipEntrySep+it)
+		}
+	}
+	return list, nil
+}
+
+// zipEntries zipファイル内でpatternに一致するファイル名の一覧を返す
+func zipEntries(archive, pattern string) ([]string, error) {
+	if pattern == "" {
+		pattern = defaultZipPattern
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("ZipPatternの指定が不正です。ZipPattern:%q %w", pattern, err)
+	}
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	entries := []string{}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		// フォルダを除いたファイル名で大文字小文字を区別せずに照合する
+		ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(path.Base(f.Name)))
+		if ok {
+			entries = append(entries, f.Name)
+		}
+	}
+	return entries, nil
+}
+
+// openInput 入力ファイルを開く
+// gzipとzstdは展開しながら読み込み、zipファイル内のCSVはそのファイルだけを読み込む
+func openInput(rp string) (io.ReadCloser, error) {
+	if archive, entry, ok := splitZipEntry(rp); ok {
+		return openZipEntry(archive, entry)
+	}
+	f, err := os.Open(rp)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(rp)) {
+	case extGzip:
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("gzipファイルが読み込めませんでした。%w", err)
+		}
+		return &readCloser{Reader: gr, closers: []io.Closer{f, gr}}, nil
+	case extZstd:
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("zstdファイルが読み込めませんでした。%w", err)
+		}
+		zc := zr.IOReadCloser()
+		return &readCloser{Reader: zc, closers: []io.Closer{f, zc}}, nil
+	}
+	return f, nil
+}
+
+func openZipEntry(archive, entry string) (io.ReadCloser, error) {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range zr.File {
+		if f.Name != entry {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			zr.Close()
+			return nil, err
+		}
+		return &readCloser{Reader: r, closers: []io.Closer{zr, r}}, nil
+	}
+	zr.Close()
+	return nil, fmt.Errorf("zipファイル内にファイルがありません。zip:%s ファイル名:%s", archive, entry)
+}
+
+// readCloser 展開用のReaderと元のファイルをまとめて閉じる
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+// Close 後から開いたものから順に閉じる
+func (rc *readCloser) Close() error {
+	var err error
+	for i := len(rc.closers) - 1; i >= 0; i-- {
+		if e := rc.closers[i].Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
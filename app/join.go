@@ -0,0 +1,134 @@
+package app
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tanaton/CSVToExcelGraph/app/config"
+)
+
+// ファイルを結合する順番
+const (
+	joinByName = "name"
+	joinByTime = "time"
+)
+
+// orderJoinFiles 結合するファイルをJoinの指定に従って並べ替える
+func orderJoinFiles(c *config.Config, files []string) ([]string, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("結合するファイルがありません。")
+	}
+	list := append([]string(nil), files...)
+	switch strings.ToLower(c.Join) {
+	case joinByName:
+		sort.Strings(list)
+	case joinByTime:
+		first := make(map[string]int64, len(list))
+		for _, rp := range list {
+			x, err := firstX(c, rp)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", filepath.Base(rp), err)
+			}
+			first[rp] = x
+		}
+		sort.SliceStable(list, func(i, j int) bool {
+			return first[list[i]] < first[list[j]]
+		})
+	default:
+		return nil, fmt.Errorf("ファイルの結合方法の指定が不正です。Join:%q", c.Join)
+	}
+	return list, nil
+}
+
+// firstX ファイルの最初のデータ行のXをナノ秒で返す
+func firstX(c *config.Config, rp string) (int64, error) {
+	swc, err := newScanReader(c, rp)
+	if err != nil {
+		return 0, err
+	}
+	defer swc.Close()
+	csv, err := NewCSVReducer(c)
+	if err != nil {
+		return 0, err
+	}
+	if err := csv.scanHeader(swc, c); err != nil {
+		return 0, err
+	}
+	for {
+		cells, err := csv.nextRow(swc)
+		if err != nil {
+			return 0, err
+		}
+		if cells == nil {
+			break
+		}
+		if x, ok := csv.rawX(cells); ok {
+			return x, nil
+		}
+	}
+	return 0, fmt.Errorf("X列の値が解釈できる行がありませんでした。")
+}
+
+// nextFile 結合する次のファイルに切り替えてヘッダーを読み飛ばす
+// 次のファイルが無い場合はfalseを返す
+func (csv *CSVReducer) nextFile(swc ScanWriteCloser, c *config.Config) (bool, error) {
+	if csv.fileIndex+1 >= len(csv.files) {
+		return false, nil
+	}
+	csv.fileIndex++
+	if err := swc.Open(c, csv.files[csv.fileIndex]); err != nil {
+		return false, err
+	}
+	csv.linenum = 0
+	// タイトルに使うメタデータは最初のファイルのものを使う
+	metadata := csv.metadata
+	header, err := csv.findHeader(swc, c)
+	csv.metadata = metadata
+	if err != nil {
+		return false, err
+	}
+	cells, err := parseRecord(nil, header, csv.comma)
+	if err != nil {
+		return false, fmt.Errorf("csvのヘッダーが読み込めませんでした。%w", err)
+	}
+	if !sameHeader(cells, csv.header) {
+		return false, fmt.Errorf("ヘッダーが最初のファイルと一致しません。最初のファイル:%s", filepath.Base(csv.files[0]))
+	}
+	if _, err := csv.scanUnits(swc, c); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// sameHeader 前後の空白を除いて列名がすべて一致する場合にtrueを返す
+func sameHeader(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if strings.TrimSpace(a[i]) != strings.TrimSpace(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// fileError 複数のファイルを結合している場合はエラーにファイル名を付ける
+func (csv *CSVReducer) fileError(err error) error {
+	if err == nil || len(csv.files) <= 1 {
+		return err
+	}
+	return fmt.Errorf("%s: %w", filepath.Base(csv.files[csv.fileIndex]), err)
+}
+
+// badRowString 不正な行の位置をログ用の文字列にする
+// 複数のファイルを結合している場合は"ファイル名:行番号"とする
+func (csv *CSVReducer) badRowString(r badRow) string {
+	if len(csv.files) <= 1 {
+		return strconv.Itoa(r.line)
+	}
+	return fmt.Sprintf("%s:%d", filepath.Base(csv.files[r.file]), r.line)
+}
@@ -0,0 +1,56 @@
+package app
+
+import (
+	"strings"
+)
+
+// parseMetadata ヘッダー行より前の行をキーと値の組に変換する
+// "キー,値"のような区切り文字形式と"キー: 値" "キー=値"形式に対応する
+func parseMetadata(lines []string, delimiter string) map[string]string {
+	meta := make(map[string]string, len(lines))
+	for _, line := range lines {
+		key, value, ok := splitMetadata(line, delimiter)
+		if ok {
+			meta[key] = value
+		}
+	}
+	return meta
+}
+
+func splitMetadata(line, delimiter string) (string, string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return "", "", false
+	}
+	if comma, err := parseDelimiter(delimiter, line); err == nil {
+		if cells, err := parseRecord(nil, line, comma); err == nil && len(cells) >= 2 {
+			key := strings.TrimSpace(cells[0])
+			values := []string{}
+			for _, it := range cells[1:] {
+				if v := strings.TrimSpace(it); v != "" {
+					values = append(values, v)
+				}
+			}
+			if key != "" {
+				return key, strings.Join(values, " "), true
+			}
+		}
+	}
+	if i := strings.IndexAny(line, ":="); i > 0 {
+		return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]), true
+	}
+	return "", "", false
+}
+
+// expandTitle タイトルの{キー}をメタデータの値に置換する
+// タイトルの指定が無い場合は空文字を返す
+func expandTitle(title, file string, meta map[string]string) string {
+	if title == "" {
+		return ""
+	}
+	oldnew := []string{"{file}", file}
+	for k, v := range meta {
+		oldnew = append(oldnew, "{"+k+"}", v)
+	}
+	return strings.NewReplacer(oldnew...).Replace(title)
+}
@@ -0,0 +1,210 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/tanaton/CSVToExcelGraph/app/config"
+)
+
+// 欠損値の処理方法
+const (
+	missingBlank       = "blank"
+	missingPrevious    = "previous"
+	missingInterpolate = "interpolate"
+	missingDrop        = "drop"
+)
+
+// 数値でない値すべてを欠損値とみなす指定
+const missingNonNumeric = "*"
+
+// missingColumn 列ごとの欠損値の設定
+type missingColumn struct {
+	values     map[string]struct{}
+	nonNumeric bool
+	strategy   string
+}
+
+// newMissingColumn 列の設定と全体の設定から欠損値の設定を生成する
+// 欠損値の指定が無い場合はnilを返す
+func newMissingColumn(it config.Column, c *config.Config) (*missingColumn, error) {
+	values := it.MissingValues
+	if values == nil {
+		values = c.MissingValues
+	}
+	strategy := it.Missing
+	if strategy == "" {
+		strategy = c.Missing
+	}
+	strategy = strings.ToLower(strategy)
+	switch strategy {
+	case "":
+		strategy = missingBlank
+	case missingBlank, missingPrevious, missingInterpolate, missingDrop:
+	default:
+		return nil, fmt.Errorf("欠損値の処理方法の指定が不正です。Missing:%q", strategy)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	mc := &missingColumn{
+		values:   make(map[string]struct{}, len(values)),
+		strategy: strategy,
+	}
+	for _, v := range values {
+		if v == missingNonNumeric {
+			mc.nonNumeric = true
+			continue
+		}
+		mc.values[strings.TrimSpace(v)] = struct{}{}
+	}
+	return mc, nil
+}
+
+// match 変換前のセルが欠損値の場合にtrueを返す
+func (mc *missingColumn) match(cell string) bool {
+	cell = strings.TrimSpace(cell)
+	if _, ok := mc.values[cell]; ok {
+		return true
+	}
+	return mc.nonNumeric && math.IsNaN(parseCell(cell))
+}
+
+// missingHandler 欠損値を処理してから次の処理に行を渡す
+// 線形補間する列がある場合は次の有効な値が出るまで行を保持する
+type missingHandler struct {
+	columns []*missingColumn
+	outX    func(string) (int64, bool)
+	last    []string
+	lastx   []float64
+	lastv   []float64
+	hasLast []bool
+	pending [][]int
+	queue   []*missingRow
+	base    int
+	seq     int
+}
+
+// missingRow 補間待ちの行
+type missingRow struct {
+	linenum    int
+	row        []string
+	x          float64
+	unresolved int
+}
+
+// newMissingHandler 出力列ごとの設定から欠損値の処理を生成する
+// 欠損値の指定がある列が無い場合はnilを返す
+func newMissingHandler(columns []*missingColumn, outX func(string) (int64, bool)) *missingHandler {
+	used := false
+	for _, mc := range columns {
+		used = used || mc != nil
+	}
+	if !used {
+		return nil
+	}
+	n := len(columns)
+	return &missingHandler{
+		columns: columns,
+		outX:    outX,
+		last:    make([]string, n),
+		lastx:   make([]float64, n),
+		lastv:   make([]float64, n),
+		hasLast: make([]bool, n),
+		pending: make([][]int, n),
+	}
+}
+
+// push 1行分の欠損値を処理する。missingは列ごとに欠損値かどうか
+// 保持した行も読み込んだ時の行番号でnextに渡す
+func (h *missingHandler) push(linenum int, row []string, missing []bool, next func(linenum int, row []string)) {
+	for i, mc := range h.columns {
+		if mc != nil && missing[i] && mc.strategy == missingDrop {
+			// 行ごと除く
+			return
+		}
+	}
+	seq := h.seq
+	h.seq++
+	x := float64(seq)
+	if ns, ok := h.outX(row[0]); ok {
+		x = float64(ns)
+	}
+	unresolved := 0
+	for i, mc := range h.columns {
+		if mc == nil {
+			continue
+		}
+		if missing[i] {
+			switch mc.strategy {
+			case missingBlank:
+				row[i] = ""
+			case missingPrevious:
+				row[i] = h.last[i]
+			case missingInterpolate:
+				row[i] = ""
+				h.pending[i] = append(h.pending[i], seq)
+				unresolved++
+			}
+			continue
+		}
+		h.last[i] = row[i]
+		if mc.strategy == missingInterpolate {
+			h.resolve(i, x, parseCell(row[i]))
+		}
+	}
+	if len(h.queue) == 0 && unresolved == 0 {
+		h.base = h.seq
+		next(linenum, row)
+		return
+	}
+	h.queue = append(h.queue, &missingRow{
+		linenum:    linenum,
+		row:        append([]string(nil), row...),
+		x:          x,
+		unresolved: unresolved,
+	})
+	h.drain(next)
+}
+
+// resolve 有効な値が出たので補間待ちのセルを埋める
+func (h *missingHandler) resolve(col int, x, v float64) {
+	if math.IsNaN(v) {
+		// 数値でない値は補間に使えない
+		return
+	}
+	for _, seq := range h.pending[col] {
+		mr := h.queue[seq-h.base]
+		if h.hasLast[col] && x != h.lastx[col] {
+			t := (mr.x - h.lastx[col]) / (x - h.lastx[col])
+			mr.row[col] = formatCell(h.lastv[col] + t*(v-h.lastv[col]))
+		}
+		// 先頭の欠損値は補間できないので空欄のまま
+		mr.unresolved--
+	}
+	h.pending[col] = h.pending[col][:0]
+	h.lastx[col], h.lastv[col], h.hasLast[col] = x, v, true
+}
+
+// drain 補間が済んだ行を先頭から順に次の処理に渡す
+func (h *missingHandler) drain(next func(linenum int, row []string)) {
+	for len(h.queue) > 0 && h.queue[0].unresolved == 0 {
+		next(h.queue[0].linenum, h.queue[0].row)
+		h.queue[0] = nil
+		h.queue = h.queue[1:]
+		h.base++
+	}
+}
+
+// flush 末尾の補間できない欠損値を空欄のまま残りの行を出力する
+func (h *missingHandler) flush(next func(linenum int, row []string)) {
+	for _, it := range h.queue {
+		next(it.linenum, it.row)
+	}
+	h.base += len(h.queue)
+	h.queue = nil
+	for i := range h.pending {
+		h.pending[i] = h.pending[i][:0]
+	}
+}
@@ -0,0 +1,170 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tanaton/CSVToExcelGraph/app/config"
+)
+
+// overlayResult 重ねたグラフ用の中間CSVの情報
+type overlayResult struct {
+	secondaries []int
+	groups      []string
+	metadata    map[string]string
+	stats       []*columnStats
+	xformat     string
+}
+
+// CreateOverlayGraph 複数のファイルを1つのグラフに重ねて生成する
+func CreateOverlayGraph(c *config.Config, files []string) (string, error) {
+	if len(files) == 0 {
+		return "", fmt.Errorf("重ねるファイルがありません。")
+	}
+	if c.Join != "" {
+		return "", fmt.Errorf("JoinとOverlayは同時に指定できません。")
+	}
+	dir, base := outputBase(files[0])
+	base += "_overlay"
+	dp, _ := filepath.Abs(filepath.Join(dir, base+"_graph.csv"))
+	ov, err := overlayCSV(c, files, dp)
+	if err != nil {
+		return "", err
+	}
+	title := expandTitle(c.Title, base, ov.metadata)
+	var summary [][]interface{}
+	if c.Stats {
+		if err := writeStatsJSON(filepath.Join(dir, base+"_stats.json"), ov.stats); err != nil {
+			return "", err
+		}
+		summary = statsSheet(ov.stats, ov.xformat)
+	}
+	return renderGraph(dp, title, ov.secondaries, ov.groups, summary, ov.xformat)
+}
+
+// overlayCSV ファイルごとに間引いたCSVを空の列で区切って横に並べる
+// グラフでは区切られた列のまとまりごとにX列を持つ系列になる
+func overlayCSV(c *config.Config, files []string, wp string) (*overlayResult, error) {
+	ov := &overlayResult{}
+	parts := make([]string, 0, len(files))
+	defer func() {
+		for _, it := range parts {
+			os.Remove(it)
+		}
+	}()
+	offset := 0
+	for i, rp := range files {
+		part := fmt.Sprintf("%s.%d.tmp", wp, i)
+		parts = append(parts, part)
+		csv, err := reduceCSV(c, rp, part)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(rp), err)
+		}
+		if i == 0 {
+			ov.metadata = csv.metadata
+			ov.xformat = csv.xFormat()
+		}
+		// 第2軸の指定は全ファイルを通した系列の番号にする
+		for _, it := range csv.secondaries {
+			ov.secondaries = append(ov.secondaries, it+offset)
+		}
+		offset += len(csv.columnlist) + len(csv.derived) - 1
+		if csv.rmsColumns {
+			offset += len(csv.columnlist) + len(csv.derived) - 1
+		}
+		_, name := outputBase(rp)
+		ov.groups = append(ov.groups, name+": ")
+		for _, it := range csv.stats {
+			// 凡例と同じくファイル名を付ける
+			it.name = name + ": " + it.name
+			ov.stats = append(ov.stats, it)
+		}
+	}
+	if err := mergeColumns(parts, ov.groups, wp); err != nil {
+		return nil, err
+	}
+	return ov, nil
+}
+
+// mergeColumns 中間CSVを空の列で区切って横に並べる
+// 行数が足りないファイルは空欄で補い、Y列の列名にはprefixesを付ける
+func mergeColumns(parts, prefixes []string, wp string) error {
+	type source struct {
+		sc    *bufio.Scanner
+		f     *os.File
+		width int
+		done  bool
+	}
+	srcs := make([]*source, len(parts))
+	defer func() {
+		for _, it := range srcs {
+			if it != nil {
+				it.f.Close()
+			}
+		}
+	}()
+	for i, p := range parts {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 0, readBuffSize), maxLineSize(-1))
+		sc.Split((&recordSplitter{comma: outComma}).split)
+		srcs[i] = &source{sc: sc, f: f}
+	}
+	raww, err := os.Create(wp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(raww, writeBuffSize)
+	w.WriteString(utf8BOM)
+	row := []string{}
+	cells := []string{}
+	for line := 0; ; line++ {
+		row = row[:0]
+		rest := false
+		for i, src := range srcs {
+			if i > 0 {
+				// 列のまとまりの区切り
+				row = append(row, "")
+			}
+			if !src.done && src.sc.Scan() {
+				cells, err = parseRecord(cells, strings.TrimPrefix(src.sc.Text(), utf8BOM), outComma)
+				if err != nil {
+					raww.Close()
+					return err
+				}
+				if line == 0 {
+					src.width = len(cells)
+					for k := 1; k < len(cells); k++ {
+						cells[k] = prefixes[i] + cells[k]
+					}
+				}
+				row = append(row, cells...)
+				rest = true
+				continue
+			}
+			if err := src.sc.Err(); err != nil {
+				raww.Close()
+				return err
+			}
+			src.done = true
+			for k := 0; k < src.width; k++ {
+				row = append(row, "")
+			}
+		}
+		if !rest {
+			break
+		}
+		w.WriteString(joinRecord(row, outComma) + Newline)
+	}
+	if err := w.Flush(); err != nil {
+		raww.Close()
+		return err
+	}
+	return raww.Close()
+}
@@ -0,0 +1,425 @@
+package app
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/tanaton/CSVToExcelGraph/app/config"
+	"go.uber.org/atomic"
+)
+
+// 並列化を自動で行う入力ファイルの合計サイズ
+const parallelMinSize = 64 * 1024 * 1024
+
+// 並列で処理する1まとまりの行数
+const parallelChunkLines = 4096
+
+// 経過時間の基準となる行を探す間に保持するまとまりの上限
+// 超えた場合は以降のまとまりを読み込んだ順に1つずつ解析する（テストで変更するため変数）
+var parallelMaxHeld = 256
+
+// activeJobs 同時に実行しているグラフ生成の数（自動で決める並列数をCPU数から分け合うため）
+var activeJobs = atomic.NewInt32(0)
+
+// parallelChunk 並列で解析する行のまとまり（同じファイルの連続した行のみ）
+type parallelChunk struct {
+	file       int
+	first      int
+	opened     bool
+	openLine   int
+	sequential bool
+	lines      []string
+	err        error
+	items      []parallelItem
+	done       chan struct{}
+}
+
+// parallelItem 1行分の解析結果
+type parallelItem struct {
+	linenum int
+	row     []string
+	missing []bool
+	bad     bool
+	padded  bool
+	stop    bool
+	err     error
+}
+
+// parallelWorkers 並列数を求める。1以下の場合は並列化しない
+// 自動の場合は同時に実行しているグラフ生成の数でCPU数を分け合う
+func parallelWorkers(c *config.Config, files []string) int {
+	switch {
+	case c.Parallel > 0:
+		return c.Parallel
+	case c.Parallel < 0:
+		return 1
+	}
+	var size int64
+	for _, rp := range files {
+		// zipファイル内のCSVはサイズが分からないので数えない
+		if fi, err := os.Stat(rp); err == nil {
+			size += fi.Size()
+		}
+	}
+	if size < parallelMinSize {
+		return 1
+	}
+	n := runtime.NumCPU()
+	if jobs := int(activeJobs.Load()); jobs > 1 {
+		n /= jobs
+	}
+	return n
+}
+
+// scanRowsParallel データ行を並列で解析し、読み込んだ順に処理する
+// 行の読み込みは1つのgoroutineで行い、区切りと列の選択や変換は行のまとまりごとに並列で行う
+// 統計値、欠損値、フィルタ、間引きは前の行の結果に依存するため読み込んだ順に1つずつ処理し、
+// 出力は1行ずつ処理する場合と同じになる（まとめた行の集計と出力する行の文字列化はoutputPoolで並列に行う）
+func (csv *CSVReducer) scanRowsParallel(swc ScanWriteCloser, c *config.Config, process func(linenum int, row []string)) error {
+	work := make(chan *parallelChunk, csv.workers)
+	order := make(chan *parallelChunk, csv.workers*2)
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		csv.readChunks(swc, c, work, order, quit)
+	}()
+	for i := 0; i < csv.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ch := range work {
+				csv.parseChunk(ch)
+			}
+		}()
+	}
+
+	last, stopped, file := 0, -1, 0
+	badRows := []badRow{}
+	paddedRows := []badRow{}
+	var err error
+loop:
+	for ch := range order {
+		if ch.sequential {
+			// 経過時間の基準が決まっていないため読み込んだ順に解析する
+			csv.parseChunk(ch)
+		}
+		<-ch.done
+		if ch.file == stopped {
+			// OnBadRowが"stop"の場合はファイルの残りを読まない
+			continue
+		}
+		file = ch.file
+		if ch.opened {
+			last = ch.openLine
+		}
+		for _, it := range ch.items {
+			last = it.linenum
+			if it.err != nil {
+				err = it.err
+				break loop
+			}
+			if it.bad {
+				badRows = append(badRows, badRow{file: ch.file, line: it.linenum})
+			}
+			if it.padded {
+				paddedRows = append(paddedRows, badRow{file: ch.file, line: it.linenum})
+			}
+			if it.stop {
+				stopped = ch.file
+				break
+			}
+			if it.row == nil {
+				continue
+			}
+			if csv.stats != nil {
+				csv.updateStats(it.row, it.missing)
+			}
+			if csv.missing != nil {
+				csv.missing.push(it.linenum, it.row, it.missing, process)
+			} else {
+				process(it.linenum, it.row)
+			}
+		}
+		if ch.err != nil && ch.file != stopped {
+			err = ch.err
+			break
+		}
+	}
+	close(quit)
+	wg.Wait()
+	// 1行ずつ処理した場合と同じ状態にする
+	csv.linenum = last
+	csv.badRows = append(csv.badRows, badRows...)
+	csv.paddedRows = append(csv.paddedRows, paddedRows...)
+	if err != nil {
+		csv.fileIndex = file
+	}
+	return err
+}
+
+// readChunks 行を読み込んでまとまりごとに解析へ渡す
+// 経過時間の基準となる行が見つかるまでは解析に渡さずに保持する
+// 保持するまとまりが上限を超えた場合は、以降のまとまりを解析せずに渡して読み込んだ順に解析させる
+func (csv *CSVReducer) readChunks(swc ScanWriteCloser, c *config.Config, work, order chan<- *parallelChunk, quit <-chan struct{}) {
+	defer close(work)
+	defer close(order)
+	search := csv.elapsed && !csv.hasOrigin
+	sequential := false
+	skipFile := -1
+	held := []*parallelChunk{}
+	flush := func() bool {
+		for _, it := range held {
+			select {
+			case order <- it:
+			case <-quit:
+				return false
+			}
+			if it.sequential {
+				continue
+			}
+			select {
+			case work <- it:
+			case <-quit:
+				return false
+			}
+		}
+		held = held[:0]
+		return true
+	}
+	send := func(ch *parallelChunk) bool {
+		held = append(held, ch)
+		if search && len(held) >= parallelMaxHeld {
+			// 基準はこのgoroutineでは探さずに、読み込んだ順に解析する中で探す
+			search, sequential = false, true
+			for _, it := range held {
+				it.sequential = true
+			}
+		}
+		if search {
+			return true
+		}
+		return flush()
+	}
+	newChunk := func() *parallelChunk {
+		return &parallelChunk{
+			file:       csv.fileIndex,
+			first:      csv.linenum + 1,
+			sequential: sequential,
+			lines:      make([]string, 0, parallelChunkLines),
+			done:       make(chan struct{}),
+		}
+	}
+	var buf []string
+	ch := newChunk()
+	for {
+		for swc.Scan() {
+			csv.linenum++
+			line := swc.Text()
+			ch.lines = append(ch.lines, line)
+			if search && csv.fileIndex != skipFile {
+				// 最初の行を経過時間の基準にする
+				cells, err := parseRecord(buf, line, csv.comma)
+				buf = cells
+				policy, err := csv.checkRow(csv.linenum, cells, err)
+				switch {
+				case err != nil:
+					// 読み込みを中断するため基準は使われない
+					search = false
+				case policy == badRowSkip:
+				case policy == badRowStop:
+					skipFile = csv.fileIndex
+				default:
+					buf = csv.padRow(cells)
+					if x, ok := csv.rawX(buf); ok {
+						csv.origin, csv.hasOrigin = x, true
+						search = false
+					}
+				}
+			}
+			if len(ch.lines) >= parallelChunkLines {
+				if !send(ch) {
+					return
+				}
+				ch = newChunk()
+			}
+		}
+		ch.err = swc.Err()
+		if ch.err != nil && csv.fileIndex != skipFile {
+			// 読み込みを中断するため基準は使われない
+			search = false
+		}
+		if !send(ch) {
+			return
+		}
+		ok, err := csv.nextFile(swc, c)
+		if err != nil {
+			ch = newChunk()
+			ch.err = err
+			search = false
+			send(ch)
+			return
+		}
+		if !ok {
+			// 基準が見つからなかった場合も保持している行を渡す
+			search = false
+			flush()
+			return
+		}
+		ch = newChunk()
+		ch.opened, ch.openLine = true, csv.linenum
+	}
+}
+
+// parseChunk まとまりの各行を区切り、選択した列を取り出す
+func (csv *CSVReducer) parseChunk(ch *parallelChunk) {
+	defer close(ch.done)
+	var buf []string
+	linenum := ch.first - 1
+	for _, line := range ch.lines {
+		linenum++
+		it := parallelItem{linenum: linenum}
+		cells, err := parseRecord(buf, line, csv.comma)
+		buf = cells
+		policy, err := csv.checkRow(linenum, cells, err)
+		if err != nil {
+			it.err = err
+			ch.items = append(ch.items, it)
+			break
+		}
+		it.bad = policy != ""
+		if policy == badRowStop {
+			it.stop = true
+			ch.items = append(ch.items, it)
+			break
+		}
+		if policy == badRowSkip {
+			ch.items = append(ch.items, it)
+			continue
+		}
+		it.padded = policy == "" && len(cells) < csv.hmax
+		buf = csv.padRow(cells)
+		if ch.sequential && csv.elapsed && !csv.hasOrigin {
+			// 最初の行を経過時間の基準にする
+			if x, ok := csv.rawX(buf); ok {
+				csv.origin, csv.hasOrigin = x, true
+			}
+		}
+		if csv.rowFilter == nil || csv.rowFilter(buf) {
+			it.row = make([]string, len(csv.bufcolumns))
+			if csv.missing != nil {
+				it.missing = make([]bool, len(csv.columnlist))
+			}
+			csv.selectRow(buf, it.row, it.missing)
+		}
+		ch.items = append(ch.items, it)
+	}
+	ch.lines = nil
+}
+
+// outputItem 出力する1行、または行を出力する集計処理
+type outputItem struct {
+	row []string
+	run func(emit emitFunc)
+}
+
+// outputJob 並列で文字列にする出力のまとまり
+type outputJob struct {
+	items []outputItem
+	text  string
+	done  chan struct{}
+}
+
+// outputPool 間引き処理の集計と出力する行の文字列化を並列に行い、渡した順に書き出す
+type outputPool struct {
+	items []outputItem
+	size  int
+	jobs  chan *outputJob
+	order chan *outputJob
+	wg    sync.WaitGroup
+}
+
+// newOutputPool workers個のgoroutineで文字列にし、1つのgoroutineでwに書き出す
+func newOutputPool(w io.StringWriter, workers int) *outputPool {
+	p := &outputPool{
+		jobs:  make(chan *outputJob, workers),
+		order: make(chan *outputJob, workers*2),
+	}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for j := range p.jobs {
+				j.exec()
+			}
+		}()
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for j := range p.order {
+			<-j.done
+			w.WriteString(j.text)
+		}
+	}()
+	return p
+}
+
+// exec まとまりの行を文字列にする
+func (j *outputJob) exec() {
+	defer close(j.done)
+	var b strings.Builder
+	emit := func(row []string) {
+		b.WriteString(joinRecord(row, outComma))
+		b.WriteString(Newline)
+	}
+	for _, it := range j.items {
+		if it.run != nil {
+			it.run(emit)
+		} else {
+			emit(it.row)
+		}
+	}
+	j.text = b.String()
+}
+
+// emit 行を出力する（emitFunc）
+// 並列で処理する行は使い回さないため、コピーせずに保持する
+func (p *outputPool) emit(row []string) {
+	p.add(outputItem{row: row}, 1)
+}
+
+// async jobを並列に実行させる（asyncFunc）
+func (p *outputPool) async(rows int, job func(emit emitFunc)) {
+	p.add(outputItem{run: job}, rows)
+}
+
+func (p *outputPool) add(it outputItem, rows int) {
+	p.items = append(p.items, it)
+	p.size += rows
+	if p.size >= parallelChunkLines {
+		p.submit()
+	}
+}
+
+// submit ためた出力をまとまりとして渡す
+func (p *outputPool) submit() {
+	j := &outputJob{items: p.items, done: make(chan struct{})}
+	p.items, p.size = nil, 0
+	p.order <- j
+	p.jobs <- j
+}
+
+// close 残りを書き出して終了を待つ
+func (p *outputPool) close() {
+	if len(p.items) > 0 {
+		p.submit()
+	}
+	close(p.order)
+	close(p.jobs)
+	p.wg.Wait()
+}
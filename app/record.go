@@ -0,0 +1,218 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// recordSplitter RFC 4180形式のレコード単位で分割する
+// 引用符で囲まれた中の改行ではレコードを区切らない
+type recordSplitter struct {
+	// 区切り文字（0の間は区切り文字の候補の直後をフィールドの先頭とみなす）
+	comma byte
+}
+
+// split bufio.SplitFunc
+// parseRecordと同じく、フィールドの先頭の引用符のみ引用符で囲まれたフィールドの始まりとする
+func (rs *recordSplitter) split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	quoted := false
+	// フィールドの先頭かどうか
+	start := true
+	// 直前が閉じる引用符かどうか（続く引用符はエスケープ）
+	closed := false
+	for i, c := range data {
+		if quoted {
+			if c == '"' {
+				quoted, closed = false, true
+			}
+			continue
+		}
+		switch {
+		case c == '"' && (start || closed):
+			// フィールドの途中の引用符は通常の文字として扱う
+			quoted = true
+		case c == '\n':
+			return i + 1, dropCR(data[:i]), nil
+		}
+		start = rs.isComma(c)
+		closed = false
+	}
+	if atEOF {
+		// 最終行に改行が無い場合
+		return len(data), dropCR(data), nil
+	}
+	// 続きを読み込む
+	return 0, nil, nil
+}
+
+// isComma 区切り文字の場合にtrueを返す
+func (rs *recordSplitter) isComma(c byte) bool {
+	if rs.comma == 0 {
+		return bytes.IndexByte(delimiterCandidates, c) >= 0
+	}
+	return c == rs.comma
+}
+
+func dropCR(data []byte) []byte {
+	if len(data) > 0 && data[len(data)-1] == '\r' {
+		return data[:len(data)-1]
+	}
+	return data
+}
+
+// parseRecord 1レコード分の文字列をフィールドに分割する
+// dstの領域を再利用して結果を返す
+func parseRecord(dst []string, s string, comma byte) ([]string, error) {
+	dst = dst[:0]
+	for {
+		if len(s) == 0 || s[0] != '"' {
+			// 引用符で囲まれていないフィールド
+			i := strings.IndexByte(s, comma)
+			if i < 0 {
+				return append(dst, s), nil
+			}
+			dst = append(dst, s[:i])
+			s = s[i+1:]
+			continue
+		}
+		// 引用符で囲まれたフィールド
+		var b strings.Builder
+		s = s[1:]
+		for {
+			i := strings.IndexByte(s, '"')
+			if i < 0 {
+				return dst, fmt.Errorf("引用符が閉じられていません。")
+			}
+			b.WriteString(s[:i])
+			s = s[i+1:]
+			if len(s) > 0 && s[0] == '"' {
+				// エスケープされた引用符
+				b.WriteByte('"')
+				s = s[1:]
+				continue
+			}
+			break
+		}
+		dst = append(dst, b.String())
+		if len(s) == 0 {
+			return dst, nil
+		}
+		if s[0] != comma {
+			return dst, fmt.Errorf("引用符の後に区切り文字以外の文字があります。")
+		}
+		s = s[1:]
+	}
+}
+
+// joinRecord フィールドを連結して1レコード分の文字列にする
+// 必要なフィールドのみ引用符で囲む
+func joinRecord(cells []string, comma byte) string {
+	var buf bytes.Buffer
+	for i, cell := range cells {
+		if i > 0 {
+			buf.WriteByte(comma)
+		}
+		if !fieldNeedsQuotes(cell, comma) {
+			buf.WriteString(cell)
+			continue
+		}
+		buf.WriteByte('"')
+		buf.WriteString(strings.ReplaceAll(cell, `"`, `""`))
+		buf.WriteByte('"')
+	}
+	return buf.String()
+}
+
+func fieldNeedsQuotes(cell string, comma byte) bool {
+	if cell == "" {
+		return false
+	}
+	return strings.IndexByte(cell, comma) >= 0 || strings.ContainsAny(cell, "\"\r\n")
+}
+
+// 自動判定の対象とする区切り文字（先頭ほど優先）
+var delimiterCandidates = []byte{',', '\t', ';', '|'}
+
+// fixedDelimiter ヘッダー行を読まずに決まる区切り文字を返す
+// "auto"や不正な指定の場合は0を返す
+func fixedDelimiter(s string) byte {
+	if strings.ToLower(s) == "auto" {
+		return 0
+	}
+	comma, err := parseDelimiter(s, "")
+	if err != nil {
+		return 0
+	}
+	return comma
+}
+
+// parseDelimiter 設定値から区切り文字を決定する
+// "auto"の場合はヘッダー行から推測する
+func parseDelimiter(s, header string) (byte, error) {
+	switch strings.ToLower(s) {
+	case "", ",", "comma":
+		return ',', nil
+	case "\t", "tab", "tsv":
+		return '\t', nil
+	case ";", "semicolon":
+		return ';', nil
+	case "|", "pipe":
+		return '|', nil
+	case "auto":
+		return sniffDelimiter(header), nil
+	}
+	if len(s) == 1 && s[0] != '"' && s[0] != '\r' && s[0] != '\n' {
+		return s[0], nil
+	}
+	return 0, fmt.Errorf("区切り文字の指定が不正です。Delimiter:%q", s)
+}
+
+// sniffDelimiter 引用符の外で最も多く出現する区切り文字を返す
+func sniffDelimiter(header string) byte {
+	var count [256]int
+	quoted := false
+	for i := 0; i < len(header); i++ {
+		c := header[i]
+		if c == '"' {
+			quoted = !quoted
+		} else if !quoted {
+			count[c]++
+		}
+	}
+	best := delimiterCandidates[0]
+	for _, c := range delimiterCandidates[1:] {
+		if count[c] > count[best] {
+			best = c
+		}
+	}
+	return best
+}
+
+// parseDecimalSeparator 設定値から小数点の文字を決定する
+func parseDecimalSeparator(s string) (byte, error) {
+	switch s {
+	case "", ".":
+		return '.', nil
+	case ",":
+		return ',', nil
+	}
+	return 0, fmt.Errorf("小数点の指定が不正です。DecimalSeparator:%q", s)
+}
+
+// normalizeDecimal 小数点が"."以外の数値を"."に変換する
+// 数値として解釈できない値はそのまま返す
+func normalizeDecimal(cell string, decimal byte) string {
+	if decimal == '.' || decimal == 0 || strings.IndexByte(cell, decimal) < 0 {
+		return cell
+	}
+	v := strings.Replace(cell, string(decimal), ".", 1)
+	if _, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+		return cell
+	}
+	return v
+}
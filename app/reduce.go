@@ -0,0 +1,640 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tanaton/CSVToExcelGraph/app/config"
+)
+
+// 間引き方法
+const (
+	reduceModeRows   = "rows"
+	reduceModeLTTB   = "lttb"
+	reduceModeMinMax = "minmax"
+	reduceModeTime   = "time"
+	reduceModeMean   = "mean"
+)
+
+// 集計方法
+const (
+	aggregateFirst  = "first"
+	aggregateLast   = "last"
+	aggregateMean   = "mean"
+	aggregateMin    = "min"
+	aggregateMax    = "max"
+	aggregateMedian = "median"
+)
+
+// emitFunc 間引き後の行を出力する
+type emitFunc func(row []string)
+
+// reduceFunc 1行ごとに呼び出される間引き処理
+// 出力する行はemitに渡す（rowは呼び出し後に再利用されるので保持する場合はコピーすること）
+type reduceFunc func(linenum int, row []string, emit emitFunc)
+
+// flushFunc 全行読み込み後に呼び出され、保持している行を出力する
+type flushFunc func(emit emitFunc)
+
+// asyncFunc jobを並列に実行させる。jobが出力した行は、emitで出力した行と合わせて渡した順に書き出される
+// rowsはjobが処理する行数（並列に実行する単位をまとめる目安）
+type asyncFunc func(rows int, job func(emit emitFunc))
+
+// setReducer 設定に応じた間引き処理を設定する
+func (csv *CSVReducer) setReducer(c *config.Config) error {
+	switch strings.ToLower(c.ReduceMode) {
+	case "", reduceModeRows:
+		if c.ReduceRows > 0 {
+			csv.reduceFunc = reduceRows(c.ReduceRows)
+		}
+	case reduceModeLTTB:
+		if c.ReducePoints < 3 {
+			return fmt.Errorf("LTTBで間引く場合はReducePointsに3以上を指定してください。ReducePoints:%d", c.ReducePoints)
+		}
+		l := &lttbReducer{points: c.ReducePoints}
+		csv.prescanFunc = l.prescan
+		csv.preFlush = l.prescanFlush
+		csv.preAsync = l.setPrescanAsync
+		csv.reduceFunc = l.reduce
+		csv.flushFunc = l.flush
+	case reduceModeMinMax:
+		g, err := newGroupReducer(c, aggregateMinMax, csv.outX)
+		if err != nil {
+			return err
+		}
+		csv.reduceAsync = g.setAsync
+		csv.reduceFunc = g.reduce
+		csv.flushFunc = g.flush
+		csv.reduceErr = g.Err
+	case reduceModeTime:
+		if c.ReduceInterval == "" {
+			return fmt.Errorf("時間間隔で間引く場合はReduceIntervalの指定が必要です。")
+		}
+		f, err := aggregateBy(c.ReduceAggregate)
+		if err != nil {
+			return err
+		}
+		g, err := newGroupReducer(c, f, csv.outX)
+		if err != nil {
+			return err
+		}
+		// Xは間隔の区切りの位置にする
+		g.gridX = csv.formatOutX
+		csv.reduceAsync = g.setAsync
+		csv.reduceFunc = g.reduce
+		csv.flushFunc = g.flush
+		csv.reduceErr = g.Err
+	case reduceModeMean:
+		if c.ReduceRows <= 0 {
+			return fmt.Errorf("平均で間引く場合はReduceRowsの指定が必要です。")
+		}
+		g, err := newGroupReducer(c, aggregateAverage(c.ReduceRMS), csv.outX)
+		if err != nil {
+			return err
+		}
+		csv.reduceAsync = g.setAsync
+		csv.reduceFunc = g.reduce
+		csv.flushFunc = g.flush
+		csv.reduceErr = g.Err
+		csv.rmsColumns = c.ReduceRMS
+	default:
+		return fmt.Errorf("間引き方法の指定が不正です。ReduceMode:%q", c.ReduceMode)
+	}
+	return nil
+}
+
+// reduceRows rows行ごとに1行残す
+func reduceRows(rows int) reduceFunc {
+	return func(linenum int, row []string, emit emitFunc) {
+		if linenum%rows == 0 {
+			emit(row)
+		}
+	}
+}
+
+// parseCell セルを数値に変換する。数値でない場合はNaNを返す
+func parseCell(cell string) float64 {
+	v, err := strconv.ParseFloat(strings.TrimSpace(cell), 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return v
+}
+
+// formatCell 数値をセルの文字列に変換する
+func formatCell(v float64) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// lttbPoint LTTBで比較する1行分のデータ
+type lttbPoint struct {
+	row  []string
+	vals []float64 // 先頭がX、以降がY
+}
+
+// lttbReducer Largest-Triangle-Three-Bucketsによる間引き
+// 1回目の読み込みで行数と値の範囲を調べ、2回目でバケット単位に処理するので
+// メモリに保持するのは前後2バケット分の行のみ
+type lttbReducer struct {
+	points int
+	// 1回目の読み込みで得る情報
+	rows     int
+	min, max []float64
+	// 2回目の読み込み中の状態
+	index   int
+	every   float64
+	prev    lttbPoint
+	cur     []lttbPoint
+	next    []lttbPoint
+	curb    int
+	started bool
+	// 1回目の読み込みで最小値と最大値を並列に求める場合の状態
+	async   asyncFunc
+	batch   [][]string
+	batchAt int
+	mu      sync.Mutex
+}
+
+func (l *lttbReducer) prescan(_ int, row []string, _ emitFunc) {
+	if l.async != nil {
+		// 行のまとまりごとに並列で求める
+		if len(l.batch) == 0 {
+			l.batchAt = l.rows
+		}
+		l.batch = append(l.batch, append([]string(nil), row...))
+		l.rows++
+		if len(l.batch) >= parallelChunkLines {
+			l.prescanFlush(nil)
+		}
+		return
+	}
+	l.min, l.max = l.extend(l.min, l.max, l.rows, row)
+	l.rows++
+}
+
+// prescanFlush 1回目の読み込みでまとめている行の最小値と最大値を求める
+func (l *lttbReducer) prescanFlush(_ emitFunc) {
+	if len(l.batch) == 0 {
+		return
+	}
+	batch, at := l.batch, l.batchAt
+	l.batch = nil
+	l.async(len(batch), func(emitFunc) {
+		var min, max []float64
+		for i, row := range batch {
+			min, max = l.extend(min, max, at+i, row)
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.min == nil {
+			l.min, l.max = min, max
+			return
+		}
+		for i := range min {
+			l.min[i] = math.Min(l.min[i], min[i])
+			l.max[i] = math.Max(l.max[i], max[i])
+		}
+	})
+}
+
+// setPrescanAsync 1回目の読み込みで最小値と最大値を並列に求める
+func (l *lttbReducer) setPrescanAsync(async asyncFunc) {
+	l.async = async
+}
+
+// extend index行目の値で列ごとの最小値と最大値を更新する
+func (l *lttbReducer) extend(min, max []float64, index int, row []string) ([]float64, []float64) {
+	if min == nil {
+		min = make([]float64, len(row))
+		max = make([]float64, len(row))
+		for i := range row {
+			min[i] = math.Inf(1)
+			max[i] = math.Inf(-1)
+		}
+	}
+	for i, vals := 0, l.values(index, row); i < len(vals); i++ {
+		if math.IsNaN(vals[i]) {
+			continue
+		}
+		min[i] = math.Min(min[i], vals[i])
+		max[i] = math.Max(max[i], vals[i])
+	}
+	return min, max
+}
+
+// values 行を数値に変換する。Xが数値でない場合は行番号をXとする
+func (l *lttbReducer) values(index int, row []string) []float64 {
+	vals := make([]float64, len(row))
+	for i, cell := range row {
+		vals[i] = parseCell(cell)
+	}
+	if len(vals) > 0 && math.IsNaN(vals[0]) {
+		vals[0] = float64(index)
+	}
+	return vals
+}
+
+// bucket 行番号が属するバケット番号を返す
+// 先頭行は-1、最終行はpoints-2の単独のバケットとなる
+func (l *lttbReducer) bucket(index int) int {
+	switch {
+	case index == 0:
+		return -1
+	case index >= l.rows-1:
+		return l.points - 2
+	}
+	b := int(float64(index-1) / l.every)
+	if b > l.points-3 {
+		b = l.points - 3
+	}
+	return b
+}
+
+func (l *lttbReducer) reduce(_ int, row []string, emit emitFunc) {
+	if l.rows <= l.points {
+		// 間引く必要が無い
+		emit(row)
+		return
+	}
+	if !l.started {
+		l.every = float64(l.rows-2) / float64(l.points-2)
+		l.started = true
+	}
+	p := lttbPoint{
+		row:  append([]string(nil), row...),
+		vals: l.values(l.index, row),
+	}
+	b := l.bucket(l.index)
+	l.index++
+	switch {
+	case b < 0:
+		// 先頭行は必ず出力する
+		l.prev = p
+		emit(p.row)
+	case b == l.curb:
+		l.cur = append(l.cur, p)
+	case b == l.curb+1:
+		l.next = append(l.next, p)
+	default:
+		l.selectPoint(emit)
+		l.next = append(l.next, p)
+	}
+}
+
+// selectPoint 現在のバケットから直前の点と次のバケットの平均との三角形の面積が最大の点を出力する
+func (l *lttbReducer) selectPoint(emit emitFunc) {
+	avg := l.average(l.next)
+	best, area := 0, -1.0
+	for i, p := range l.cur {
+		a := l.area(l.prev.vals, p.vals, avg)
+		if a > area {
+			best, area = i, a
+		}
+	}
+	if len(l.cur) > 0 {
+		l.prev = l.cur[best]
+		emit(l.prev.row)
+	}
+	l.cur, l.next = l.next, nil
+	l.curb++
+}
+
+func (l *lttbReducer) average(ps []lttbPoint) []float64 {
+	avg := make([]float64, len(l.min))
+	count := make([]int, len(l.min))
+	for _, p := range ps {
+		for i, v := range p.vals {
+			if !math.IsNaN(v) {
+				avg[i] += v
+				count[i]++
+			}
+		}
+	}
+	for i := range avg {
+		if count[i] > 0 {
+			avg[i] /= float64(count[i])
+		} else {
+			avg[i] = math.NaN()
+		}
+	}
+	return avg
+}
+
+// area 列ごとの値の範囲で正規化した三角形の面積をY列分合計する
+func (l *lttbReducer) area(a, b, c []float64) float64 {
+	scale := func(i int, v float64) float64 {
+		if r := l.max[i] - l.min[i]; r > 0 && !math.IsInf(r, 0) {
+			return (v - l.min[i]) / r
+		}
+		return 0
+	}
+	ax, bx, cx := scale(0, a[0]), scale(0, b[0]), scale(0, c[0])
+	sum := 0.0
+	for i := 1; i < len(a) && i < len(b) && i < len(c); i++ {
+		ay, by, cy := scale(i, a[i]), scale(i, b[i]), scale(i, c[i])
+		s := math.Abs((ax-cx)*(by-ay) - (ax-bx)*(cy-ay))
+		if !math.IsNaN(s) {
+			sum += s
+		}
+	}
+	return sum
+}
+
+func (l *lttbReducer) flush(emit emitFunc) {
+	for len(l.cur) > 0 {
+		if l.curb >= l.points-2 {
+			// 最終行は必ず出力する
+			for _, p := range l.cur {
+				emit(p.row)
+			}
+			return
+		}
+		l.selectPoint(emit)
+	}
+}
+
+// aggregateFunc グループにまとめた行から出力する行を生成する
+type aggregateFunc func(group [][]string, emit emitFunc)
+
+// groupReducer 行数または時間間隔でグループにまとめて集計する間引き処理
+type groupReducer struct {
+	key       func(index int, row []string) (int64, bool)
+	aggregate aggregateFunc
+	group     [][]string
+	current   int64
+	hasKey    bool
+	index     int
+	err       error
+	// 時間間隔でまとめる場合の間隔（ナノ秒）
+	interval int64
+	// gridXを指定した場合、時間間隔でまとめた行のXを区切りの位置にする
+	// likeはグループ先頭のX（数値か時刻の文字列かを合わせるため）
+	gridX func(ns int64, like string) string
+	// asyncを指定した場合、グループの集計を並列に行う
+	async asyncFunc
+}
+
+// xnanosはX列の値をナノ秒に変換する関数
+func newGroupReducer(c *config.Config, aggregate aggregateFunc, xnanos func(string) (int64, bool)) (*groupReducer, error) {
+	g := &groupReducer{aggregate: aggregate}
+	switch {
+	case c.ReduceInterval != "":
+		d, err := time.ParseDuration(c.ReduceInterval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("ReduceIntervalの指定が不正です。ReduceInterval:%q", c.ReduceInterval)
+		}
+		interval := int64(d)
+		g.interval = interval
+		g.key = func(_ int, row []string) (int64, bool) {
+			x, ok := xnanos(row[0])
+			if !ok {
+				if g.err == nil && !math.IsNaN(parseCell(row[0])) {
+					// 数値だが秒として扱える範囲を超えている（UNIX時間のミリ秒など）
+					g.err = fmt.Errorf("X列の値が大きすぎるため時間間隔で間引けません。UNIX時間の場合はTimeLayoutに\"epoch\"か\"epochms\"を指定してください。X:%q", row[0])
+				}
+				return 0, false
+			}
+			// 負の値も切り捨てになるように調整
+			if x < 0 {
+				return (x - interval + 1) / interval, true
+			}
+			return x / interval, true
+		}
+	case c.ReduceRows > 0:
+		rows := c.ReduceRows
+		g.key = func(index int, _ []string) (int64, bool) {
+			return int64(index / rows), true
+		}
+	default:
+		return nil, fmt.Errorf("グループで間引く場合はReduceRowsかReduceIntervalの指定が必要です。")
+	}
+	return g, nil
+}
+
+func (g *groupReducer) reduce(_ int, row []string, emit emitFunc) {
+	key, ok := g.key(g.index, row)
+	g.index++
+	if !ok {
+		// Xが解釈できない行は現在のグループに含める
+		key = g.current
+	}
+	if len(g.group) > 0 && key != g.current {
+		g.emitGroup(emit)
+		g.hasKey = false
+	}
+	g.current = key
+	g.hasKey = g.hasKey || ok
+	g.group = append(g.group, append([]string(nil), row...))
+}
+
+func (g *groupReducer) flush(emit emitFunc) {
+	if len(g.group) > 0 {
+		g.emitGroup(emit)
+	}
+	g.group = nil
+}
+
+// emitGroup グループを集計して出力し、次のグループを始める
+func (g *groupReducer) emitGroup(emit emitFunc) {
+	group := g.group
+	aggregate := g.aggregate
+	if g.gridX != nil && g.interval > 0 && g.hasKey {
+		x := g.gridX(g.current*g.interval, group[0][0])
+		aggregate = func(group [][]string, emit emitFunc) {
+			g.aggregate(group, func(row []string) {
+				row[0] = x
+				emit(row)
+			})
+		}
+	}
+	if g.async == nil {
+		aggregate(group, emit)
+		g.group = group[:0]
+		return
+	}
+	// 集計が終わるまでグループの行は使い回さない
+	g.async(len(group), func(emit emitFunc) {
+		aggregate(group, emit)
+	})
+	g.group = make([][]string, 0, cap(group))
+}
+
+// setAsync グループの集計を並列に行う
+func (g *groupReducer) setAsync(async asyncFunc) {
+	g.async = async
+}
+
+// Err グループにまとめられなかった原因を返す
+func (g *groupReducer) Err() error {
+	return g.err
+}
+
+// columnValues グループ内のcol列目の数値を返す。数値でない値は除く
+func columnValues(group [][]string, col int) []float64 {
+	vals := make([]float64, 0, len(group))
+	for _, row := range group {
+		if v := parseCell(row[col]); !math.IsNaN(v) {
+			vals = append(vals, v)
+		}
+	}
+	return vals
+}
+
+// aggregateMinMax グループ内で各列の最小値または最大値となる行を出力する
+// 行は元の順序のまま出力し、最小値と最大値が同じ行の場合は1行とする
+// 列ごとに最小値と最大値の行が異なる場合は、それらの行をすべて出力する
+func aggregateMinMax(group [][]string, emit emitFunc) {
+	width := len(group[0])
+	keep := make([]bool, len(group))
+	found := false
+	for col := 1; col < width; col++ {
+		mini, maxi := -1, -1
+		var min, max float64
+		for i, row := range group {
+			v := parseCell(row[col])
+			if math.IsNaN(v) {
+				continue
+			}
+			if mini < 0 || v < min {
+				mini, min = i, v
+			}
+			if maxi < 0 || v > max {
+				maxi, max = i, v
+			}
+		}
+		if mini < 0 {
+			continue
+		}
+		keep[mini], keep[maxi] = true, true
+		found = true
+	}
+	if !found {
+		// 数値が無い場合はグループ先頭の行のみ
+		keep[0] = true
+	}
+	for i, row := range group {
+		if keep[i] {
+			emit(row)
+		}
+	}
+}
+
+// aggregateBy 集計方法に応じて1行に集計する関数を返す
+// Xは"last"の場合はグループ末尾、それ以外はグループ先頭の値とする
+// （時間間隔でまとめる場合は間隔の区切りの位置に置き換える）
+func aggregateBy(name string) (aggregateFunc, error) {
+	var f func(vals []float64) float64
+	xlast := false
+	switch strings.ToLower(name) {
+	case aggregateFirst:
+		f = func(vals []float64) float64 { return vals[0] }
+	case aggregateLast:
+		f = func(vals []float64) float64 { return vals[len(vals)-1] }
+		xlast = true
+	case "", aggregateMean:
+		f = mean
+	case aggregateMin:
+		f = func(vals []float64) float64 {
+			min := vals[0]
+			for _, v := range vals[1:] {
+				min = math.Min(min, v)
+			}
+			return min
+		}
+	case aggregateMax:
+		f = func(vals []float64) float64 {
+			max := vals[0]
+			for _, v := range vals[1:] {
+				max = math.Max(max, v)
+			}
+			return max
+		}
+	case aggregateMedian:
+		f = median
+	default:
+		return nil, fmt.Errorf("集計方法の指定が不正です。ReduceAggregate:%q", name)
+	}
+	return func(group [][]string, emit emitFunc) {
+		row := make([]string, len(group[0]))
+		if xlast {
+			row[0] = group[len(group)-1][0]
+		} else {
+			row[0] = group[0][0]
+		}
+		for col := 1; col < len(row); col++ {
+			if vals := columnValues(group, col); len(vals) > 0 {
+				row[col] = formatCell(f(vals))
+			}
+		}
+		emit(row)
+	}, nil
+}
+
+func mean(vals []float64) float64 {
+	sum := 0.0
+	for _, v := range vals {
+		sum += v
+	}
+	return sum / float64(len(vals))
+}
+
+func median(vals []float64) float64 {
+	s := append([]float64(nil), vals...)
+	sort.Float64s(s)
+	n := len(s)
+	if n%2 == 1 {
+		return s[n/2]
+	}
+	return (s[n/2-1] + s[n/2]) / 2
+}
+
+// aggregateAverage グループの平均値の1行を出力する
+// XはグループのXの中点とし、rmsがtrueの場合は各列の実効値を末尾に追加する
+func aggregateAverage(rms bool) aggregateFunc {
+	return func(group [][]string, emit emitFunc) {
+		width := len(group[0])
+		row := make([]string, width, width*2-1)
+		row[0] = midpointX(group)
+		for col := 1; col < width; col++ {
+			if vals := columnValues(group, col); len(vals) > 0 {
+				row[col] = formatCell(mean(vals))
+			}
+		}
+		if rms {
+			for col := 1; col < width; col++ {
+				cell := ""
+				if vals := columnValues(group, col); len(vals) > 0 {
+					cell = formatCell(rootMeanSquare(vals))
+				}
+				row = append(row, cell)
+			}
+		}
+		emit(row)
+	}
+}
+
+// midpointX グループの先頭と末尾のXの中点を返す
+// Xが数値でない場合は中央の行のXを返す
+func midpointX(group [][]string) string {
+	first, last := parseCell(group[0][0]), parseCell(group[len(group)-1][0])
+	if math.IsNaN(first) || math.IsNaN(last) {
+		return group[len(group)/2][0]
+	}
+	return formatCell((first + last) / 2)
+}
+
+func rootMeanSquare(vals []float64) float64 {
+	sum := 0.0
+	for _, v := range vals {
+		sum += v * v
+	}
+	return math.Sqrt(sum / float64(len(vals)))
+}
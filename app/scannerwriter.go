@@ -2,12 +2,23 @@ package app
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"os"
+
+	"github.com/tanaton/CSVToExcelGraph/app/config"
 )
 
 const writeBuffSize = 128 * 1024
 
+// 1行の最大サイズの既定値（MaxLineSize省略時）
+const defaultMaxLineSize = 16 * 1024 * 1024
+
+// 読み込みバッファの初期サイズ
+const readBuffSize = 64 * 1024
+
 // ScanWriteCloser 読み書き用
 type ScanWriteCloser interface {
 	io.StringWriter
@@ -16,32 +27,118 @@ type ScanWriteCloser interface {
 	Err() error
 	Scan() bool
 	Text() string
+	// Open 読み込むファイルを切り替える（出力先はそのまま）
+	Open(c *config.Config, rp string) error
+	// SetComma ヘッダー行から決まった区切り文字をレコードの分割に使う
+	SetComma(comma byte)
 }
 
 type scannerWriter struct {
 	*bufio.Scanner
 	*bufio.Writer
-	raww io.WriteCloser
-	rawr io.ReadCloser
+	raww    io.WriteCloser
+	rawr    io.ReadCloser
+	records *recordSplitter
+	lines   int
+	maxLine int
 }
 
 // NewScanWriteCloser ScanWriteCloser生成用
-func NewScanWriteCloser(rp, wp string) (ScanWriteCloser, error) {
-	rawr, err := os.Open(rp)
-	if err != nil {
+func NewScanWriteCloser(c *config.Config, rp, wp string) (ScanWriteCloser, error) {
+	rw := &scannerWriter{}
+	if err := rw.Open(c, rp); err != nil {
 		return nil, err
 	}
 	raww, werr := os.Create(wp)
 	if werr != nil {
-		rawr.Close()
+		rw.rawr.Close()
 		return nil, werr
 	}
-	return &scannerWriter{
-		Writer:  bufio.NewWriterSize(raww, writeBuffSize),
-		Scanner: bufio.NewScanner(rawr),
-		raww:    raww,
-		rawr:    rawr,
-	}, nil
+	w := bufio.NewWriterSize(raww, writeBuffSize)
+	// UTF-8に変換して出力するのでExcelが文字コードを判別できるようにBOMを付ける
+	w.WriteString(utf8BOM)
+	rw.Writer = w
+	rw.raww = raww
+	return rw, nil
+}
+
+// newScanReader 読み込みのみ行うScanWriteCloser生成用（書き込んだ内容は捨てる）
+func newScanReader(c *config.Config, rp string) (ScanWriteCloser, error) {
+	rw := &scannerWriter{
+		Writer: bufio.NewWriter(io.Discard),
+	}
+	if err := rw.Open(c, rp); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+// Open 読み込むファイルを開く。既に開いているファイルは閉じる
+func (rw *scannerWriter) Open(c *config.Config, rp string) error {
+	rawr, err := openInput(rp)
+	if err != nil {
+		return err
+	}
+	r, err := newDecodeReader(rawr, c.Encoding)
+	if err != nil {
+		rawr.Close()
+		return err
+	}
+	if rw.rawr != nil {
+		rw.rawr.Close()
+	}
+	maxLine := maxLineSize(c.MaxLineSize)
+	bufSize := readBuffSize
+	if bufSize > maxLine {
+		bufSize = maxLine
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, bufSize), maxLine)
+	// 引用符内の改行を含めて1レコードずつ読み込む
+	// 結合するファイルでは最初のファイルで決まった区切り文字を使う
+	if rw.records == nil {
+		rw.records = &recordSplitter{comma: fixedDelimiter(c.Delimiter)}
+	}
+	sc.Split(rw.records.split)
+	rw.Scanner = sc
+	rw.rawr = rawr
+	rw.lines = 0
+	rw.maxLine = maxLine
+	return nil
+}
+
+// SetComma 区切り文字を設定する
+func (rw *scannerWriter) SetComma(comma byte) {
+	rw.records.comma = comma
+}
+
+// maxLineSize 設定値から1行の最大サイズを求める
+// 0は既定値、負数は無制限とする
+func maxLineSize(n int) int {
+	switch {
+	case n == 0:
+		return defaultMaxLineSize
+	case n < 0:
+		return math.MaxInt
+	}
+	return n
+}
+
+func (rw *scannerWriter) Scan() bool {
+	if !rw.Scanner.Scan() {
+		return false
+	}
+	rw.lines++
+	return true
+}
+
+// Err 1行が長すぎる場合は行番号と上限を含めたエラーにする
+func (rw *scannerWriter) Err() error {
+	err := rw.Scanner.Err()
+	if errors.Is(err, bufio.ErrTooLong) {
+		return fmt.Errorf("csvの%d行目が長すぎるため読み込めませんでした。1行の最大サイズ:%dバイト（MaxLineSizeで変更できます、-1で無制限）", rw.lines+1, rw.maxLine)
+	}
+	return err
 }
 
 func (rw *scannerWriter) Close() error {
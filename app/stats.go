@@ -0,0 +1,145 @@
+package app
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+
+	"github.com/tanaton/CSVToExcelGraph/app/graph"
+)
+
+// columnStats 間引く前のデータから求める列ごとの統計値
+type columnStats struct {
+	name   string
+	count  int
+	min    float64
+	max    float64
+	mean   float64
+	m2     float64
+	sumsq  float64
+	first  float64
+	last   float64
+	xAtMin string
+	xAtMax string
+}
+
+// add 1点分の値を追加する。xは出力するX列の値
+// 平均と分散は桁落ちしにくいWelfordの方法で求める
+func (s *columnStats) add(x string, v float64) {
+	s.count++
+	if s.count == 1 {
+		s.min, s.max, s.first = v, v, v
+		s.xAtMin, s.xAtMax = x, x
+	} else if v < s.min {
+		s.min, s.xAtMin = v, x
+	} else if v > s.max {
+		s.max, s.xAtMax = v, x
+	}
+	s.last = v
+	d := v - s.mean
+	s.mean += d / float64(s.count)
+	s.m2 += d * (v - s.mean)
+	s.sumsq += v * v
+}
+
+// std 標準偏差（母集団）
+func (s *columnStats) std() float64 {
+	return math.Sqrt(s.m2 / float64(s.count))
+}
+
+// rms 実効値
+func (s *columnStats) rms() float64 {
+	return math.Sqrt(s.sumsq / float64(s.count))
+}
+
+// newStats Y列と計算で求める列の統計値を用意する
+func newStats(titles []string) []*columnStats {
+	stats := make([]*columnStats, len(titles))
+	for i, it := range titles {
+		stats[i] = &columnStats{name: it}
+	}
+	return stats
+}
+
+// updateStats 欠損値を処理する前の1行分の値を統計値に追加する
+// 数値でないセルと欠損値のセルは除く。missingは列ごとに欠損値かどうか（nilの場合は欠損値の指定なし）
+func (csv *CSVReducer) updateStats(row []string, missing []bool) {
+	for i, s := range csv.stats {
+		if i+1 < len(missing) && missing[i+1] {
+			continue
+		}
+		if v := parseCell(row[i+1]); !math.IsNaN(v) {
+			s.add(row[0], v)
+		}
+	}
+}
+
+// statsJSON _stats.jsonに出力する列ごとの統計値（値が無い場合は数値を省略する）
+type statsJSON struct {
+	Name   string
+	Count  int
+	Min    *float64 `json:",omitempty"`
+	XAtMin string   `json:",omitempty"`
+	Max    *float64 `json:",omitempty"`
+	XAtMax string   `json:",omitempty"`
+	Mean   *float64 `json:",omitempty"`
+	Std    *float64 `json:",omitempty"`
+	RMS    *float64 `json:",omitempty"`
+	First  *float64 `json:",omitempty"`
+	Last   *float64 `json:",omitempty"`
+}
+
+// writeStatsJSON 統計値をJSONファイルに書き出す
+func writeStatsJSON(p string, stats []*columnStats) error {
+	list := make([]statsJSON, 0, len(stats))
+	for _, s := range stats {
+		it := statsJSON{Name: s.name, Count: s.count}
+		if s.count > 0 {
+			std, rms := s.std(), s.rms()
+			it.Min, it.XAtMin = &s.min, s.xAtMin
+			it.Max, it.XAtMax = &s.max, s.xAtMax
+			it.Mean, it.Std, it.RMS = &s.mean, &std, &rms
+			it.First, it.Last = &s.first, &s.last
+		}
+		list = append(list, it)
+	}
+	b, err := json.MarshalIndent(struct{ Columns []statsJSON }{list}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, b, 0666)
+}
+
+// statsSheet Summaryシートに書き込む表を作る
+// xformatを指定すると最小と最大のXをその表示形式にする
+func statsSheet(stats []*columnStats, xformat string) [][]interface{} {
+	rows := [][]interface{}{
+		{"列", "点数", "最小", "最小のX", "最大", "最大のX", "平均", "標準偏差", "実効値", "最初", "最後"},
+	}
+	for _, s := range stats {
+		if s.count == 0 {
+			rows = append(rows, []interface{}{s.name, 0})
+			continue
+		}
+		rows = append(rows, []interface{}{
+			s.name, s.count,
+			s.min, sheetX(s.xAtMin, xformat),
+			s.max, sheetX(s.xAtMax, xformat),
+			s.mean, s.std(), s.rms(),
+			s.first, s.last,
+		})
+	}
+	return rows
+}
+
+// sheetX Xが数値の場合は数値としてシートに書き込む（シリアル値の場合は日時の表示形式にする）
+func sheetX(x, xformat string) interface{} {
+	v := parseCell(x)
+	switch {
+	case math.IsNaN(v):
+		return x
+	case xformat != "":
+		return graph.FormattedValue{Value: v, Format: xformat}
+	}
+	return v
+}
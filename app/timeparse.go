@@ -0,0 +1,132 @@
+package app
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+// X列の時刻として解釈を試みる書式
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999",
+	"2006/01/02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006/1/2 15:04:05.999999999",
+	"2006-01-02 15:04",
+	"2006/01/02 15:04",
+	"15:04:05.999999999",
+}
+
+// parseTime 時刻の文字列を解釈する
+func parseTime(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// 時刻の文字列で出力するXの書式（parseTimeで解釈できる書式）
+const outTimeLayout = "2006/01/02 15:04:05.999999999"
+
+// xNanos X列の値をナノ秒に変換する
+// 数値の場合は秒とみなし、時刻の場合はUNIX時間とする
+// ナノ秒がint64の範囲を超える数値は変換できない
+func xNanos(cell string) (int64, bool) {
+	if v := parseCell(cell); !math.IsNaN(v) {
+		return scaleNanos(v, time.Second)
+	}
+	if t, ok := parseTime(cell); ok {
+		return t.UnixNano(), true
+	}
+	return 0, false
+}
+
+// scaleNanos unit単位の数値をナノ秒に変換する
+// ナノ秒がint64の範囲を超える場合はfalseを返す
+func scaleNanos(v float64, unit time.Duration) (int64, bool) {
+	ns := math.Round(v * float64(unit))
+	// float64(math.MaxInt64)は2^63に丸められるため、それ以上は範囲外
+	if math.IsNaN(ns) || ns >= float64(math.MaxInt64) || ns < float64(math.MinInt64) {
+		return 0, false
+	}
+	return int64(ns), true
+}
+
+// X列の時刻の出力方法
+const (
+	elapsedFirst   = "first"
+	elapsedTrigger = "trigger"
+)
+
+// Excelのシリアル値の基準日（1899/12/30）とUNIX時間の差（日）
+const excelEpochDays = 25569
+
+// strftimeの書式とGoの書式の対応
+var strftimeReplacer = strings.NewReplacer(
+	"%Y", "2006",
+	"%y", "06",
+	"%m", "01",
+	"%d", "02",
+	"%e", "_2",
+	"%H", "15",
+	"%I", "03",
+	"%M", "04",
+	"%S", "05",
+	"%f", "999999999",
+	"%p", "PM",
+	"%b", "Jan",
+	"%B", "January",
+	"%a", "Mon",
+	"%A", "Monday",
+	"%j", "002",
+	"%z", "-0700",
+	"%Z", "MST",
+	"%%", "%",
+)
+
+// newTimeParser 時刻の書式からX列の値をナノ秒に変換する関数を生成する
+// 書式はGoの書式、strftime形式、"epoch"（秒）、"epochms"（ミリ秒）に対応する
+func newTimeParser(layout string) func(string) (int64, bool) {
+	switch strings.ToLower(layout) {
+	case "":
+		return xNanos
+	case "epoch", "unix":
+		return func(cell string) (int64, bool) {
+			return scaleNanos(parseCell(cell), time.Second)
+		}
+	case "epochms", "unixms":
+		return func(cell string) (int64, bool) {
+			return scaleNanos(parseCell(cell), time.Millisecond)
+		}
+	}
+	if strings.Contains(layout, "%") {
+		layout = strftimeReplacer.Replace(layout)
+	}
+	return func(cell string) (int64, bool) {
+		t, err := time.ParseInLocation(layout, strings.TrimSpace(cell), time.Local)
+		if err != nil {
+			return 0, false
+		}
+		return t.UnixNano(), true
+	}
+}
+
+// excelSerial UNIX時間のナノ秒をExcelのシリアル値（日）に変換する
+func excelSerial(ns int64) float64 {
+	t := time.Unix(0, ns)
+	_, offset := t.Zone()
+	return float64(ns+int64(offset)*int64(time.Second))/float64(24*time.Hour) + excelEpochDays
+}
+
+// fromExcelSerial Excelのシリアル値（日）をUNIX時間のナノ秒に変換する
+// シリアル値の精度は1マイクロ秒未満なので、マイクロ秒に丸めて元の時刻に戻す
+func fromExcelSerial(days float64) int64 {
+	us := math.Round((days - excelEpochDays) * float64(24*time.Hour/time.Microsecond))
+	ns := int64(us) * int64(time.Microsecond)
+	_, offset := time.Unix(0, ns).Zone()
+	return ns - int64(offset)*int64(time.Second)
+}
@@ -0,0 +1,131 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/tanaton/CSVToExcelGraph/app/config"
+)
+
+// unitDef 単位の定義
+// 基準となる単位への変換は 値*scale + offset で行う
+type unitDef struct {
+	kind   string
+	scale  float64
+	offset float64
+}
+
+// 変換可能な単位の一覧（同じkind同士で変換できる）
+var unitDefs = map[string]unitDef{
+	// 温度（基準:K）
+	"k":    {kind: "temperature", scale: 1},
+	"°c":   {kind: "temperature", scale: 1, offset: 273.15},
+	"c":    {kind: "temperature", scale: 1, offset: 273.15},
+	"degc": {kind: "temperature", scale: 1, offset: 273.15},
+	"°f":   {kind: "temperature", scale: 5.0 / 9.0, offset: 273.15 - 32*5.0/9.0},
+	"f":    {kind: "temperature", scale: 5.0 / 9.0, offset: 273.15 - 32*5.0/9.0},
+	"degf": {kind: "temperature", scale: 5.0 / 9.0, offset: 273.15 - 32*5.0/9.0},
+	// 圧力（基準:Pa）
+	"pa":   {kind: "pressure", scale: 1},
+	"hpa":  {kind: "pressure", scale: 1e2},
+	"kpa":  {kind: "pressure", scale: 1e3},
+	"mpa":  {kind: "pressure", scale: 1e6},
+	"bar":  {kind: "pressure", scale: 1e5},
+	"mbar": {kind: "pressure", scale: 1e2},
+	"psi":  {kind: "pressure", scale: 6894.757293168361},
+	"atm":  {kind: "pressure", scale: 101325},
+	"mmhg": {kind: "pressure", scale: 133.322387415},
+	// 長さ（基準:m）
+	"mm": {kind: "length", scale: 1e-3},
+	"cm": {kind: "length", scale: 1e-2},
+	"m":  {kind: "length", scale: 1},
+	"km": {kind: "length", scale: 1e3},
+	"in": {kind: "length", scale: 0.0254},
+	"ft": {kind: "length", scale: 0.3048},
+	// 速度（基準:m/s）
+	"m/s":  {kind: "speed", scale: 1},
+	"km/h": {kind: "speed", scale: 1 / 3.6},
+	"mph":  {kind: "speed", scale: 0.44704},
+	// 質量（基準:kg）
+	"g":  {kind: "mass", scale: 1e-3},
+	"kg": {kind: "mass", scale: 1},
+	"lb": {kind: "mass", scale: 0.45359237},
+	// 力（基準:N）
+	"n":   {kind: "force", scale: 1},
+	"kn":  {kind: "force", scale: 1e3},
+	"kgf": {kind: "force", scale: 9.80665},
+	"lbf": {kind: "force", scale: 4.4482216152605},
+	// トルク（基準:N·m）
+	"nm":     {kind: "torque", scale: 1},
+	"n·m":    {kind: "torque", scale: 1},
+	"kgf·m":  {kind: "torque", scale: 9.80665},
+	"lbf·ft": {kind: "torque", scale: 1.3558179483314004},
+	// 流量（基準:L/min）
+	"l/min":   {kind: "flow", scale: 1},
+	"m3/h":    {kind: "flow", scale: 1000.0 / 60},
+	"gal/min": {kind: "flow", scale: 3.785411784},
+	// 電圧（基準:V）
+	"mv": {kind: "voltage", scale: 1e-3},
+	"v":  {kind: "voltage", scale: 1},
+	"kv": {kind: "voltage", scale: 1e3},
+	// 電流（基準:A）
+	"ma": {kind: "current", scale: 1e-3},
+	"a":  {kind: "current", scale: 1},
+}
+
+// convertUnit fromの値をtoの単位に変換する関数を返す
+func convertUnit(from, to string) (func(float64) float64, error) {
+	f, fok := unitDefs[strings.ToLower(strings.TrimSpace(from))]
+	t, tok := unitDefs[strings.ToLower(strings.TrimSpace(to))]
+	if !fok || !tok {
+		return nil, fmt.Errorf("変換できない単位です。Unit:%q ConvertTo:%q", from, to)
+	}
+	if f.kind != t.kind {
+		return nil, fmt.Errorf("種類の異なる単位には変換できません。Unit:%q ConvertTo:%q", from, to)
+	}
+	return func(v float64) float64 {
+		return (v*f.scale + f.offset - t.offset) / t.scale
+	}, nil
+}
+
+// newCellTransform 列の設定に応じてセルの値を変換する関数を返す
+// 変換の必要が無い場合はnilを返す
+func newCellTransform(it config.Column, unit string) (func(string) string, error) {
+	scale := it.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	var conv func(float64) float64
+	if it.ConvertTo != "" {
+		from := it.Unit
+		if from == "" {
+			// 単位行の単位を使う
+			from = unit
+		}
+		f, err := convertUnit(from, it.ConvertTo)
+		if err != nil {
+			return nil, err
+		}
+		conv = f
+	}
+	if scale == 1 && it.Offset == 0 && conv == nil && it.Precision == 0 {
+		return nil, nil
+	}
+	return func(cell string) string {
+		v := parseCell(cell)
+		if math.IsNaN(v) {
+			// 数値でない場合はそのまま
+			return cell
+		}
+		v = v*scale + it.Offset
+		if conv != nil {
+			v = conv(v)
+		}
+		if it.Precision > 0 {
+			return strconv.FormatFloat(v, 'f', it.Precision, 64)
+		}
+		return formatCell(v)
+	}, nil
+}
@@ -0,0 +1,140 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/tanaton/CSVToExcelGraph/app/config"
+)
+
+// rowPredicate 行を残す場合にtrueを返す
+type rowPredicate func(cells []string) bool
+
+// compileRowFilter 行の絞り込み条件を生成する
+// 条件が無い場合はnilを返す
+func (csv *CSVReducer) compileRowFilter(f *config.RowFilter, header []string) (rowPredicate, error) {
+	if f == nil {
+		return nil, nil
+	}
+	preds := []rowPredicate{}
+	if f.XStart != "" || f.XEnd != "" {
+		p, err := csv.xRange(f.XStart, f.XEnd)
+		if err != nil {
+			return nil, err
+		}
+		preds = append(preds, p)
+	}
+	for _, it := range f.Where {
+		p, err := csv.compileCondition(it, header)
+		if err != nil {
+			return nil, err
+		}
+		preds = append(preds, p)
+	}
+	if len(preds) == 0 {
+		return nil, nil
+	}
+	return func(cells []string) bool {
+		for _, p := range preds {
+			if !p(cells) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// xRange Xが開始と終了の範囲内の行を残す
+func (csv *CSVReducer) xRange(start, end string) (rowPredicate, error) {
+	if len(csv.columnlist) == 0 {
+		return nil, fmt.Errorf("X軸の列が無いため範囲を指定できません。")
+	}
+	lo, hi := int64(math.MinInt64), int64(math.MaxInt64)
+	if start != "" {
+		v, ok := csv.parseXBound(start)
+		if !ok {
+			return nil, fmt.Errorf("XStartが解釈できません。XStart:%q", start)
+		}
+		lo = v
+	}
+	if end != "" {
+		v, ok := csv.parseXBound(end)
+		if !ok {
+			return nil, fmt.Errorf("XEndが解釈できません。XEnd:%q", end)
+		}
+		hi = v
+	}
+	return func(cells []string) bool {
+		x, ok := csv.rawX(cells)
+		if csv.elapsed {
+			x -= csv.origin
+		}
+		return ok && lo <= x && x <= hi
+	}, nil
+}
+
+// compileCondition 列の値の条件を生成する
+func (csv *CSVReducer) compileCondition(it config.Condition, header []string) (rowPredicate, error) {
+	cols, err := findColumns(header, config.Column{Axis: it.Axis, Header: it.Header, Match: it.Match})
+	if err != nil {
+		return nil, err
+	}
+	if len(cols) == 0 || cols[0] >= len(header) {
+		return nil, fmt.Errorf("条件で指定された列が存在しません。Axis:%q Header:%q", it.Axis, it.Header)
+	}
+	col := cols[0]
+	decimal := csv.decimal
+	value := func(cells []string) string {
+		if col >= len(cells) {
+			return ""
+		}
+		return strings.TrimSpace(normalizeDecimal(cells[col], decimal))
+	}
+	want := parseCell(it.Value)
+	switch it.Op {
+	case "==", "!=":
+		eq := func(cells []string) bool {
+			s := value(cells)
+			if v := parseCell(s); !math.IsNaN(v) && !math.IsNaN(want) {
+				return v == want
+			}
+			return s == it.Value
+		}
+		if it.Op == "!=" {
+			return func(cells []string) bool { return !eq(cells) }, nil
+		}
+		return eq, nil
+	case "<", "<=", ">", ">=":
+		if math.IsNaN(want) {
+			return nil, fmt.Errorf("比較する値が数値ではありません。Value:%q", it.Value)
+		}
+		cmp := map[string]func(a, b float64) bool{
+			"<":  func(a, b float64) bool { return a < b },
+			"<=": func(a, b float64) bool { return a <= b },
+			">":  func(a, b float64) bool { return a > b },
+			">=": func(a, b float64) bool { return a >= b },
+		}[it.Op]
+		return func(cells []string) bool {
+			v := parseCell(value(cells))
+			return !math.IsNaN(v) && cmp(v, want)
+		}, nil
+	case "between":
+		max := parseCell(it.Max)
+		if math.IsNaN(want) || math.IsNaN(max) {
+			return nil, fmt.Errorf("betweenの範囲が数値ではありません。Value:%q Max:%q", it.Value, it.Max)
+		}
+		return func(cells []string) bool {
+			v := parseCell(value(cells))
+			return want <= v && v <= max
+		}, nil
+	case "regex", "regexp":
+		re, err := regexp.Compile(it.Value)
+		if err != nil {
+			return nil, fmt.Errorf("条件の正規表現が不正です。Value:%q %w", it.Value, err)
+		}
+		return func(cells []string) bool { return re.MatchString(value(cells)) }, nil
+	}
+	return nil, fmt.Errorf("条件の演算子の指定が不正です。Op:%q", it.Op)
+}
@@ -143,7 +143,7 @@ func (mmw *MyMainWindow) Write(b []byte) (n int, err error) {
 func (mmw *MyMainWindow) OnDropFiles(files []string) {
 	if mmw.converting.Load() {
 		log.Infow("グラフ生成中に新しくドロップされたファイルは無視されます。")
-	} else if checkExtList(files, ".csv") {
+	} else if checkExtList(files, ".csv", extZip) {
 		num := runtime.NumCPU()
 		log.Infow("ファイルがドロップされました。", "ファイル数", len(files), "並列数", num)
 		// メッセージループを止めないようにgoroutineを起動させる
@@ -154,11 +154,30 @@ func (mmw *MyMainWindow) OnDropFiles(files []string) {
 				close(c)
 				mmw.converting.Store(false)
 			}()
+			// zipファイルは中のCSVファイルごとに分ける
+			files, err := expandInputs(mmw.conf, files)
+			if err != nil {
+				log.Warnw("zipファイルの読み込みに失敗しました。", "error", err)
+				return
+			}
+			if mmw.conf.Overlay && len(files) > 1 {
+				// 複数のファイルを重ねて1つのグラフにする
+				mmw.CreateOverlayGraph(files)
+				return
+			}
+			if mmw.conf.Join != "" && len(files) > 1 {
+				// 分割されたファイルを結合して1つのグラフにする
+				mmw.CreateJoinedGraph(files)
+				return
+			}
 			for _, file := range files {
 				c <- struct{}{}
+				// 行の解析を並列化する数はCPU数を同時に動作しているグラフ生成の数で分け合う
+				activeJobs.Inc()
 				// ある程度並列で動作させる
 				go func(file string) {
 					defer func() {
+						activeJobs.Dec()
 						<-c
 					}()
 					// グラフ化実行
@@ -172,7 +191,7 @@ func (mmw *MyMainWindow) OnDropFiles(files []string) {
 			}
 		}(files, num)
 	} else {
-		log.Infow("csv以外の拡張子のファイルはグラフ化できません。")
+		log.Infow("csv以外の拡張子のファイルはグラフ化できません。（.csv.gz .csv.zst .zipは可）")
 	}
 }
 
@@ -196,7 +215,27 @@ func (mmw *MyMainWindow) ReadConfigName(name string) {
 // CreateGraph GUI側グラフ生成関数読み出し
 func (mmw *MyMainWindow) CreateGraph(rp string) {
 	log.Infow("グラフ生成開始", "path", rp)
-	if ip, err := CreateGraph(mmw.conf, rp); err != nil {
+	ip, err := CreateGraph(mmw.conf, rp)
+	mmw.showGraph(ip, err)
+}
+
+// CreateJoinedGraph GUI側の結合したグラフ生成関数読み出し
+func (mmw *MyMainWindow) CreateJoinedGraph(files []string) {
+	log.Infow("結合したグラフ生成開始", "ファイル数", len(files), "並べ方", mmw.conf.Join)
+	ip, err := CreateJoinedGraph(mmw.conf, files)
+	mmw.showGraph(ip, err)
+}
+
+// CreateOverlayGraph GUI側の重ねたグラフ生成関数読み出し
+func (mmw *MyMainWindow) CreateOverlayGraph(files []string) {
+	log.Infow("重ねたグラフ生成開始", "ファイル数", len(files))
+	ip, err := CreateOverlayGraph(mmw.conf, files)
+	mmw.showGraph(ip, err)
+}
+
+// showGraph 生成したグラフ画像を表示する
+func (mmw *MyMainWindow) showGraph(ip string, err error) {
+	if err != nil {
 		log.Warnw("グラフ生成異常", "error", err)
 	} else {
 		img, err := walk.NewImageFromFileForDPI(ip, 96)
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/tanaton/CSVToExcelGraph/app/config"
+)
+
+// シリアル値で出力した時刻のExcelでの表示形式
+const xserialFormat = "yyyy/mm/dd hh:mm:ss.000"
+
+// setXColumn X列の時刻の解釈と出力方法を設定する
+func (csv *CSVReducer) setXColumn(it config.Column) error {
+	csv.xparse = newTimeParser(it.TimeLayout)
+	switch strings.ToLower(it.Elapsed) {
+	case "":
+		// 時刻の書式が指定されている場合はExcelが確実に解釈できるシリアル値で出力する
+		csv.xserial = it.TimeLayout != ""
+	case elapsedFirst:
+		csv.elapsed, csv.elapsedBy = true, elapsedFirst
+	case elapsedTrigger:
+		if it.Trigger == nil {
+			return fmt.Errorf("トリガー行からの経過時間にする場合はTriggerの指定が必要です。")
+		}
+		csv.elapsed, csv.elapsedBy = true, elapsedTrigger
+	default:
+		return fmt.Errorf("経過時間の基準の指定が不正です。Elapsed:%q", it.Elapsed)
+	}
+	return nil
+}
+
+// xFormat Excelで設定するX列の表示形式を返す
+// シリアル値で出力した場合のみ日時の形式にする
+func (csv *CSVReducer) xFormat() string {
+	if csv.xserial {
+		return xserialFormat
+	}
+	return ""
+}
+
+// rawX 読み込んだ行のXをナノ秒で返す
+func (csv *CSVReducer) rawX(cells []string) (int64, bool) {
+	if len(csv.columnlist) == 0 || csv.columnlist[0] >= len(cells) {
+		return 0, false
+	}
+	return csv.xparse(normalizeDecimal(cells[csv.columnlist[0]], csv.decimal))
+}
+
+// formatX 出力するXの文字列を返す
+func (csv *CSVReducer) formatX(cell string) string {
+	if !csv.elapsed && !csv.xserial {
+		return cell
+	}
+	x, ok := csv.xparse(cell)
+	if !ok {
+		return cell
+	}
+	if csv.elapsed {
+		// 経過秒
+		return formatCell(float64(x-csv.origin) / float64(time.Second))
+	}
+	return formatCell(excelSerial(x))
+}
+
+// outX 出力したXをナノ秒に変換する（間引きとフィルタで時間間隔を求めるため）
+func (csv *CSVReducer) outX(cell string) (int64, bool) {
+	switch {
+	case csv.elapsed:
+		return xNanos(cell)
+	case csv.xserial:
+		v := parseCell(cell)
+		if math.IsNaN(v) {
+			return 0, false
+		}
+		return fromExcelSerial(v), true
+	}
+	return csv.xparse(cell)
+}
+
+// formatOutX ナノ秒を出力するXの文字列に変換する（outXの逆変換）
+// likeは同じ列の出力したXで、X列をそのまま出力する場合に数値か時刻の文字列かを合わせる
+func (csv *CSVReducer) formatOutX(ns int64, like string) string {
+	switch {
+	case csv.xserial:
+		return formatCell(excelSerial(ns))
+	case csv.elapsed, !math.IsNaN(parseCell(like)):
+		return formatCell(float64(ns) / float64(time.Second))
+	}
+	return time.Unix(0, ns).Format(outTimeLayout)
+}
+
+// parseXBound XStartとXEndの値をナノ秒に変換する
+// 経過時間にする場合は経過秒、それ以外はX列と同じ書式か数値（秒）か時刻とみなす
+func (csv *CSVReducer) parseXBound(s string) (int64, bool) {
+	if csv.elapsed {
+		return xNanos(s)
+	}
+	if x, ok := csv.xparse(s); ok {
+		return x, true
+	}
+	return xNanos(s)
+}